@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// adminMux carries operational endpoints (metrics, profiling, backups) that
+// must not be exposed on the public file listener.
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.Handle("/metrics", metrics)
+	registerHealth(adminMux, "/")
+	adminMux.Handle("/backup", requireAdminToken(http.HandlerFunc(handleBackup)))
+	adminMux.Handle("/shares", requireAdminToken(http.HandlerFunc(handleSharesAdmin)))
+	adminMux.Handle("/audit", requireAdminToken(http.HandlerFunc(handleAuditAdmin)))
+	adminMux.Handle("/status", requireAdminToken(http.HandlerFunc(handleStatus)))
+}
+
+// requireAdminToken guards an admin endpoint with the -admin-token bearer
+// token, also accepted as the basic auth password so that browsers can open
+// the admin pages. Without a configured token the endpoint stays disabled.
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if goServAdminToken == "" {
+			http.Error(w, "Forbidden, set -admin-token to enable", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(goServAdminToken)) != 1 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="goserv admin"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="goserv admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleBackup streams a consistent copy of the live database.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	db, err := GetBoltInstance().boltDB()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="bolt-%s.db"`, time.Now().Format("20060102T150405")))
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		slog.Error("backup", "err", err)
+	}
+}
+
+// registerPprof exposes the runtime profiles locally, as an alternative to
+// pushing them to a pyroscope server. Profiles reveal memory contents, so
+// they are behind the admin token, and cmdline, which would print the
+// -admin-token and -token-secret flags, is left out.
+func registerPprof(mux *http.ServeMux) {
+	runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(5)
+	mux.Handle("/debug/pprof/", requireAdminToken(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/profile", requireAdminToken(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", requireAdminToken(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", requireAdminToken(http.HandlerFunc(pprof.Trace)))
+}
+
+func startAdmin(addr string) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           adminMux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	slog.Info("admin listening", "addr", addr)
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil {
+			slog.Error("admin listener", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterPprof(t *testing.T) {
+	saved := goServAdminToken
+	goServAdminToken = "s3cret"
+	defer func() { goServAdminToken = saved }()
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	var tests = []struct {
+		target string
+		token  string
+		want   int
+	}{
+		{"/debug/pprof/goroutine?debug=1", "s3cret", http.StatusOK},
+		{"/debug/pprof/goroutine?debug=1", "", http.StatusUnauthorized},
+		{"/debug/pprof/cmdline", "s3cret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditQueryLimit caps the events returned by one query unless it asks for
+// fewer.
+const auditQueryLimit = 10000
+
+// auditRetries is how often a failed audit write is attempted before its
+// events are given up, waiting auditRetryDelay, doubled each time, in
+// between.
+const auditRetries = 5
+
+var auditRetryDelay = 100 * time.Millisecond
+
+// AuditEvent is one entry of the audit trail. Events are keyed by the time
+// they happened, so iterating the audit bucket yields them in order. User
+// is set only from a verified access token; BasicUser is whatever name the
+// client sent with Basic auth and proves nothing.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+	BasicUser string    `json:"basic_user,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Action    string    `json:"action"`
+	Path      string    `json:"path"`
+	Target    string    `json:"target,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Status    int       `json:"status,omitempty"`
+}
+
+// newAuditEvent returns an event of action on key by the client of r.
+func newAuditEvent(r *http.Request, action string, key string) AuditEvent {
+	ev := AuditEvent{
+		Time:   time.Now().UTC(),
+		User:   getTokenUser(r),
+		IP:     getClientIP(r),
+		Action: action,
+		Path:   key,
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		ev.BasicUser = user
+	}
+	return ev
+}
+
+// getAuditKey returns a key that sorts by time: zero padded nanoseconds
+// and a random suffix against collisions.
+func getAuditKey(t time.Time) string {
+	return fmt.Sprintf("%020d-%s", t.UnixNano(), randomHex(4))
+}
+
+// getClientIP returns the address of the peer without the port.
+func getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// appendAuditBatch adds events to the audit bucket in one transaction.
+// Entries are never updated; only pruneAudit removes them.
+func appendAuditBatch(events []AuditEvent) error {
+	return GetBoltInstance().store.Update(context.Background(), func(tx StoreTx) error {
+		for _, ev := range events {
+			v, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			err = tx.Put(auditBucket, getAuditKey(ev.Time), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// commitAudit writes events with appendAuditBatch, retrying a failed
+// transaction so a passing error such as a briefly full disk does not
+// drop a batch of the trail. Events that still cannot be written are
+// logged one by one at error level and counted in
+// goserv_audit_events_lost_total, so nothing disappears unnoticed.
+func commitAudit(events []AuditEvent) error {
+	var err error
+	delay := auditRetryDelay
+	for i := 0; i < auditRetries; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = appendAuditBatch(events)
+		if err == nil {
+			return nil
+		}
+		slog.Warn("audit write", "events", len(events), "attempt", i+1, "err", err)
+	}
+	auditLost.add(float64(len(events)))
+	for _, ev := range events {
+		slog.Error("audit event lost", "time", ev.Time, "user", ev.User, "basic_user", ev.BasicUser,
+			"ip", ev.IP, "action", ev.Action, "path", ev.Path, "target", ev.Target,
+			"bytes", ev.Bytes, "status", ev.Status, "err", err)
+	}
+	return err
+}
+
+var auditQueue *WriteQueue[AuditEvent]
+
+// startAuditQueue batches access events like startWriteQueue batches
+// progress.
+func startAuditQueue(size int) {
+	if size <= 0 {
+		return
+	}
+	auditQueue = NewWriteQueue(size, commitAudit)
+}
+
+// appendAudit adds ev to the audit trail, through the audit queue when one
+// is running.
+func appendAudit(ev AuditEvent) error {
+	if auditQueue != nil {
+		return auditQueue.enqueue(ev)
+	}
+	return commitAudit([]AuditEvent{ev})
+}
+
+// recordAudit appends an action taken by the client of r.
+func recordAudit(r *http.Request, action string, key string, target string) error {
+	ev := newAuditEvent(r, action, key)
+	ev.Target = target
+	return appendAudit(ev)
+}
+
+// auditRequests records every response of next in the audit trail, with
+// the handler name as the action. key maps the request to the path it
+// accessed.
+func auditRequests(key func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !goServAuditAccess {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := r.Context().Value(handlerNameKey{}).(*string); !ok {
+			handler := ""
+			r = r.WithContext(context.WithValue(r.Context(), handlerNameKey{}, &handler))
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		action := getHandlerName(r)
+		if action == "" || action == "other" {
+			action = "access"
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			action += ":" + strings.ToLower(r.Method)
+		}
+		ev := newAuditEvent(r, action, key(r))
+		ev.Bytes, ev.Status = sw.bytes, sw.status
+		err := appendAudit(ev)
+		if err != nil {
+			slog.Error("audit", "path", r.URL.Path, "err", err)
+		}
+	})
+}
+
+// getURLKey is the key of requests whose path, prefix stripped, is the
+// served path.
+func getURLKey(r *http.Request) string {
+	return cleanKey(r.URL.Path)
+}
+
+// AuditFilter selects events of the audit trail. Zero fields match all.
+type AuditFilter struct {
+	User      string
+	BasicUser string
+	Prefix    string
+	Action    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// parseAuditTime accepts RFC 3339 or a duration counted back from now.
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseAuditFilter reads a filter from user, basic_user, path, action,
+// since, until and limit, shared by /audit and `goserv db audit`.
+func parseAuditFilter(q url.Values, now time.Time) (AuditFilter, error) {
+	f := AuditFilter{User: q.Get("user"), BasicUser: q.Get("basic_user"), Action: q.Get("action"), Limit: auditQueryLimit}
+	if p := q.Get("path"); p != "" {
+		f.Prefix = cleanKey(p)
+	}
+	var err error
+	f.Since, err = parseAuditTime(q.Get("since"), now)
+	if err != nil {
+		return f, fmt.Errorf("since: %w", err)
+	}
+	f.Until, err = parseAuditTime(q.Get("until"), now)
+	if err != nil {
+		return f, fmt.Errorf("until: %w", err)
+	}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return f, fmt.Errorf("limit: invalid value %q", l)
+		}
+		f.Limit = min(n, auditQueryLimit)
+	}
+	return f, nil
+}
+
+func (f AuditFilter) match(ev AuditEvent) bool {
+	if f.User != "" && ev.User != f.User {
+		return false
+	}
+	if f.BasicUser != "" && ev.BasicUser != f.BasicUser {
+		return false
+	}
+	if f.Action != "" && ev.Action != f.Action {
+		return false
+	}
+	if f.Prefix != "" && !inScope(ev.Path, f.Prefix) && (ev.Target == "" || !inScope(ev.Target, f.Prefix)) {
+		return false
+	}
+	return true
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// queryAudit returns the events matching f, oldest first.
+func queryAudit(f AuditFilter) ([]AuditEvent, error) {
+	start := ""
+	if !f.Since.IsZero() {
+		start = fmt.Sprintf("%020d", f.Since.UnixNano())
+	}
+	end := ""
+	if !f.Until.IsZero() {
+		end = fmt.Sprintf("%020d", f.Until.UnixNano())
+	}
+	var events []AuditEvent
+	err := GetBoltInstance().store.View(context.Background(), func(tx StoreTx) error {
+		return tx.Seek(auditBucket, start, func(k string, v []byte) error {
+			if end != "" && k > end {
+				return errStopIteration
+			}
+			var ev AuditEvent
+			if json.Unmarshal(v, &ev) != nil || !f.match(ev) {
+				return nil
+			}
+			events = append(events, ev)
+			if f.Limit > 0 && len(events) >= f.Limit {
+				return errStopIteration
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, errStopIteration) {
+		err = nil
+	}
+	return events, err
+}
+
+// pruneAudit removes the events older than retention and returns how many
+// were removed.
+func pruneAudit(now time.Time, retention time.Duration) (int, error) {
+	cutoff := fmt.Sprintf("%020d", now.Add(-retention).UnixNano())
+	var stale []string
+	store := GetBoltInstance().store
+	err := store.View(context.Background(), func(tx StoreTx) error {
+		return tx.Iterate(auditBucket, "", func(k string, v []byte) error {
+			if k >= cutoff {
+				return errStopIteration
+			}
+			stale = append(stale, k)
+			return nil
+		})
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return 0, err
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	return len(stale), store.Update(context.Background(), func(tx StoreTx) error {
+		for _, k := range stale {
+			err := tx.Delete(auditBucket, k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// startAuditRetention prunes the audit trail hourly when -audit-retention
+// is set.
+func startAuditRetention(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			n, err := pruneAudit(time.Now(), retention)
+			if err != nil {
+				slog.Warn("prune audit", "err", err)
+			} else if n > 0 {
+				slog.Info("pruned audit", "events", n)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+var auditCSVHeader = []string{"time", "user", "basic_user", "ip", "action", "path", "target", "bytes", "status"}
+
+func writeAuditCSV(w io.Writer, events []AuditEvent) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(auditCSVHeader)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		err = cw.Write([]string{
+			ev.Time.Format(time.RFC3339Nano),
+			ev.User,
+			ev.BasicUser,
+			ev.IP,
+			ev.Action,
+			ev.Path,
+			ev.Target,
+			strconv.FormatInt(ev.Bytes, 10),
+			strconv.Itoa(ev.Status),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handleAuditAdmin answers audit queries on the admin listener, as JSON or
+// with ?format=csv as CSV.
+func handleAuditAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	f, err := parseAuditFilter(q, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := queryAudit(f)
+	if err != nil {
+		slog.Error("audit query", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeAuditCSV(w, events)
+		if err != nil {
+			slog.Warn("write audit", "err", err)
+		}
+		return
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"events": events, "count": len(events)})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditEpoch keeps the events of these tests apart from the ones other
+// tests record at the current time.
+var auditEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestQueryAudit(t *testing.T) {
+	err := appendAuditBatch([]AuditEvent{
+		{Time: auditEpoch.Add(1 * time.Hour), User: "qa-alice", Action: "file", Path: "qa/show/e01.mkv"},
+		{Time: auditEpoch.Add(2 * time.Hour), User: "qa-bob", Action: "file", Path: "qa/show/e02.mkv"},
+		{Time: auditEpoch.Add(3 * time.Hour), User: "qa-alice", Action: "listing", Path: "qa/other"},
+		{Time: auditEpoch.Add(4 * time.Hour), User: "qa-alice", Action: "move", Path: "qa/tmp/x", Target: "qa/show/x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := auditEpoch.Add(5 * time.Hour)
+	var tests = []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"user", "user=qa-alice", []string{"qa/show/e01.mkv", "qa/other", "qa/tmp/x"}},
+		{"prefix", "path=qa/show", []string{"qa/show/e01.mkv", "qa/show/e02.mkv", "qa/tmp/x"}},
+		{"action", "action=file&path=qa", []string{"qa/show/e01.mkv", "qa/show/e02.mkv"}},
+		{"range", "path=qa&since=2001-01-01T01:30:00Z&until=2001-01-01T03:30:00Z", []string{"qa/show/e02.mkv", "qa/other"}},
+		{"relative", "path=qa&since=90m", []string{"qa/tmp/x"}},
+		{"limit", "path=qa&limit=1", []string{"qa/show/e01.mkv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			f, err := parseAuditFilter(q, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Until = minTime(f.Until, now)
+			events, err := queryAudit(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ev := range events {
+				got = append(got, ev.Path)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	for _, bad := range []string{"since=yesterday", "limit=-1"} {
+		q, _ := url.ParseQuery(bad)
+		if _, err := parseAuditFilter(q, now); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+// minTime bounds an open ended range to the test epoch.
+func minTime(t time.Time, max time.Time) time.Time {
+	if t.IsZero() || t.After(max) {
+		return max
+	}
+	return t
+}
+
+func TestPruneAudit(t *testing.T) {
+	err := appendAuditBatch([]AuditEvent{
+		{Time: auditEpoch.Add(-48 * time.Hour), User: "prune", Action: "file", Path: "prune/old"},
+		{Time: auditEpoch.Add(-time.Hour), User: "prune", Action: "file", Path: "prune/new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := pruneAudit(auditEpoch, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("pruned %d events, want 1", n)
+	}
+	events, err := queryAudit(AuditFilter{User: "prune", Until: auditEpoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Path != "prune/new" {
+		t.Errorf("left %+v", events)
+	}
+}
+
+func TestAuditRequests(t *testing.T) {
+	setupServedDir(t, "audited/a.txt")
+	handler := http.StripPrefix("/", checkAccessToken(auditRequests(getURLKey, logRequests(http.HandlerFunc(handlePath)))))
+	r := httptest.NewRequest("GET", "/audited/a.txt", nil)
+	r.SetBasicAuth("auditor", "")
+	r.RemoteAddr = "192.0.2.7:50000"
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("GET", "/audited/missing.txt", nil)
+	r.SetBasicAuth("auditor", "")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("GET", "/audited/a.txt?"+accessTokenParam+"="+mintAccessToken("verified", "audited", time.Hour), nil)
+	r.SetBasicAuth("auditor", "")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	events, err := queryAudit(AuditFilter{BasicUser: "auditor", Prefix: "audited", Since: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events: %+v", len(events), events)
+	}
+	ev := events[0]
+	if ev.Action != "file" || ev.Path != "audited/a.txt" || ev.Bytes != 7 || ev.Status != http.StatusOK || ev.IP != "192.0.2.7" {
+		t.Errorf("file event %+v", ev)
+	}
+	if ev.User != "" {
+		t.Errorf("basic auth name recorded as user: %+v", ev)
+	}
+	if events[1].Status != http.StatusNotFound {
+		t.Errorf("missing file event %+v", events[1])
+	}
+	if events[2].User != "verified" {
+		t.Errorf("token event %+v", events[2])
+	}
+}
+
+func TestAuditAdmin(t *testing.T) {
+	err := appendAuditBatch([]AuditEvent{{Time: auditEpoch, User: "admin-q", Action: "file", Path: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := goServAdminToken
+	goServAdminToken = "s3cret"
+	defer func() { goServAdminToken = saved }()
+	get := func(target string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		adminMux.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("/audit?user=admin-q", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", w.Code)
+	}
+	w := get("/audit?user=admin-q", "s3cret")
+	var res struct {
+		Events []AuditEvent
+		Count  int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Count != 1 || res.Events[0].Path != "x" {
+		t.Errorf("json: %d %s", w.Code, w.Body.String())
+	}
+	w = get("/audit?user=admin-q&format=csv", "s3cret")
+	if !strings.HasPrefix(w.Body.String(), "time,user,basic_user,ip,action,path,target,bytes,status\n") || !strings.Contains(w.Body.String(), ",admin-q,,,file,x,") {
+		t.Errorf("csv: %s", w.Body.String())
+	}
+	if w := get("/audit?since=never", "s3cret"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad filter: got %d", w.Code)
+	}
+}
+
+// failingStore fails the next fails updates.
+type failingStore struct {
+	Store
+	fails int
+}
+
+func (fs *failingStore) Update(ctx context.Context, fn func(tx StoreTx) error) error {
+	if fs.fails > 0 {
+		fs.fails--
+		return errors.New("disk full")
+	}
+	return fs.Store.Update(ctx, fn)
+}
+
+func TestCommitAuditRetries(t *testing.T) {
+	bolton := GetBoltInstance()
+	fs := &failingStore{Store: bolton.store}
+	bolton.store = fs
+	savedDelay := auditRetryDelay
+	auditRetryDelay = 0
+	t.Cleanup(func() {
+		bolton.store = fs.Store
+		auditRetryDelay = savedDelay
+	})
+	ev := AuditEvent{Time: auditEpoch.Add(-72 * time.Hour), User: "retry", Action: "file", Path: "retried"}
+	fs.fails = auditRetries - 1
+	if err := commitAudit([]AuditEvent{ev}); err != nil {
+		t.Fatalf("transient failure: %v", err)
+	}
+	fs.fails = auditRetries
+	ev.Path = "lost"
+	if err := commitAudit([]AuditEvent{ev}); err == nil {
+		t.Errorf("persistent failure not reported")
+	}
+	events, err := queryAudit(AuditFilter{User: "retry", Until: auditEpoch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Path != "retried" {
+		t.Errorf("got %+v", events)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTransferQueueTimeout = errors.New("timed out waiting for a download slot")
+
+// ConnLimiter caps the connections of a listener: in total, by holding
+// back Accept until one closes, and per peer address, by closing the
+// excess right away.
+type ConnLimiter struct {
+	mu       sync.Mutex
+	max      int
+	maxPerIP int
+	slots    chan struct{}
+	perIP    map[string]int
+	rejected int64
+}
+
+func NewConnLimiter(max int, maxPerIP int) *ConnLimiter {
+	cl := &ConnLimiter{max: max, maxPerIP: maxPerIP, perIP: map[string]int{}}
+	if max > 0 {
+		cl.slots = make(chan struct{}, max)
+	}
+	return cl
+}
+
+// limitListener applies cl to the connections accepted from ln.
+func (cl *ConnLimiter) limitListener(ln net.Listener) net.Listener {
+	return &limitedListener{Listener: ln, cl: cl}
+}
+
+type limitedListener struct {
+	net.Listener
+	cl *ConnLimiter
+}
+
+func (ll *limitedListener) Accept() (net.Conn, error) {
+	for {
+		if ll.cl.slots != nil {
+			ll.cl.slots <- struct{}{}
+		}
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			ll.cl.releaseSlot()
+			return nil, err
+		}
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if ll.cl.admit(ip) {
+			return &limitedConn{Conn: conn, release: func() { ll.cl.release(ip) }}, nil
+		}
+		ll.cl.releaseSlot()
+		conn.Close()
+	}
+}
+
+func (cl *ConnLimiter) releaseSlot() {
+	if cl.slots != nil {
+		<-cl.slots
+	}
+}
+
+// admit counts a connection from ip unless ip is at -max-conns-per-ip.
+func (cl *ConnLimiter) admit(ip string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.maxPerIP > 0 && cl.perIP[ip] >= cl.maxPerIP {
+		cl.rejected++
+		rejectedConns.inc()
+		return false
+	}
+	cl.perIP[ip]++
+	return true
+}
+
+func (cl *ConnLimiter) release(ip string) {
+	cl.mu.Lock()
+	cl.perIP[ip]--
+	if cl.perIP[ip] <= 0 {
+		delete(cl.perIP, ip)
+	}
+	cl.mu.Unlock()
+	cl.releaseSlot()
+}
+
+// counts returns the open connections by address and the number of
+// connections turned away.
+func (cl *ConnLimiter) counts() (map[string]int, int64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	m := make(map[string]int, len(cl.perIP))
+	for k, v := range cl.perIP {
+		m[k] = v
+	}
+	return m, cl.rejected
+}
+
+// open returns the number of open connections.
+func (cl *ConnLimiter) open() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	n := 0
+	for _, v := range cl.perIP {
+		n += v
+	}
+	return n
+}
+
+// limitedConn gives back its slot on the first Close.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (lc *limitedConn) Close() error {
+	err := lc.Conn.Close()
+	lc.once.Do(lc.release)
+	return err
+}
+
+// TransferLimiter caps concurrent file transfers, in total and per client.
+// Requests over the cap wait in a queue served in arrival order, except
+// that a waiter whose client is at its own cap does not hold up the
+// others behind it.
+type TransferLimiter struct {
+	mu           sync.Mutex
+	max          int
+	maxPerClient int
+	active       map[string]int
+	total        int
+	queue        []*transferWaiter
+}
+
+type transferWaiter struct {
+	client string
+	ready  chan struct{}
+}
+
+func NewTransferLimiter(max int, maxPerClient int) *TransferLimiter {
+	return &TransferLimiter{max: max, maxPerClient: maxPerClient, active: map[string]int{}}
+}
+
+func (tl *TransferLimiter) fits(client string) bool {
+	return (tl.max <= 0 || tl.total < tl.max) && (tl.maxPerClient <= 0 || tl.active[client] < tl.maxPerClient)
+}
+
+func (tl *TransferLimiter) take(client string) {
+	tl.total++
+	tl.active[client]++
+}
+
+// dispatch hands freed slots to the waiters that fit, oldest first.
+func (tl *TransferLimiter) dispatch() {
+	queue := tl.queue[:0]
+	for _, tw := range tl.queue {
+		if tl.fits(tw.client) {
+			tl.take(tw.client)
+			close(tw.ready)
+			continue
+		}
+		queue = append(queue, tw)
+	}
+	tl.queue = queue
+}
+
+// acquire waits up to timeout for a transfer slot of client. The returned
+// function gives the slot back.
+func (tl *TransferLimiter) acquire(ctx context.Context, client string, timeout time.Duration) (func(), error) {
+	release := func() {
+		tl.mu.Lock()
+		tl.total--
+		tl.active[client]--
+		if tl.active[client] <= 0 {
+			delete(tl.active, client)
+		}
+		tl.dispatch()
+		tl.mu.Unlock()
+	}
+	tl.mu.Lock()
+	if len(tl.queue) == 0 && tl.fits(client) {
+		tl.take(client)
+		tl.mu.Unlock()
+		return release, nil
+	}
+	tw := &transferWaiter{client: client, ready: make(chan struct{})}
+	tl.queue = append(tl.queue, tw)
+	// a client at its own cap must not block the ones queued behind it
+	tl.dispatch()
+	tl.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-tw.ready:
+		return release, nil
+	case <-timer.C:
+		err = errTransferQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	for i, q := range tl.queue {
+		if q == tw {
+			tl.queue = append(tl.queue[:i], tl.queue[i+1:]...)
+			return nil, err
+		}
+	}
+	// granted while timing out: the slot is ours after all
+	return release, nil
+}
+
+// counts returns the transfers in progress by client and the number of
+// queued requests.
+func (tl *TransferLimiter) counts() (map[string]int, int) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	m := make(map[string]int, len(tl.active))
+	for k, v := range tl.active {
+		m[k] = v
+	}
+	return m, len(tl.queue)
+}
+
+var (
+	connLimiter     *ConnLimiter
+	transferLimiter *TransferLimiter
+)
+
+// startConnLimits builds the limiters configured by -max-conns,
+// -max-conns-per-ip, -max-downloads and -max-downloads-per-client. The
+// connection counts are kept even without limits for the status page.
+func startConnLimits() {
+	connLimiter = NewConnLimiter(goServMaxConns, goServMaxConnsPerIP)
+	transferLimiter = NewTransferLimiter(goServMaxDownloads, goServMaxDownloadsPerClient)
+}
+
+// getWriteTimeout returns the WriteTimeout of the server handling r, or 0
+// when there is none.
+func getWriteTimeout(r *http.Request) time.Duration {
+	if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+		return srv.WriteTimeout
+	}
+	return 0
+}
+
+// sendFile transfers the file name within the download limits and the
+// bandwidth limits of the client. Time spent in the download queue does
+// not count against the WriteTimeout of the server: the deadline covers
+// the queue and is set afresh once the transfer starts.
+func sendFile(w http.ResponseWriter, r *http.Request, name string) {
+	if transferLimiter != nil {
+		timeout := getWriteTimeout(r)
+		rc := http.NewResponseController(w)
+		if timeout > 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(goServDownloadQueueTimeout + timeout))
+		}
+		release, err := transferLimiter.acquire(r.Context(), getClientKey(r, rateClock.now()), goServDownloadQueueTimeout)
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, goServDownloadQueueTimeout.Seconds()))))
+			http.Error(w, "Too many downloads in progress, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		if timeout > 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(timeout))
+		}
+	}
+	activeDownloads.add(1)
+	defer activeDownloads.add(-1)
+	http.ServeFile(throttleResponse(w, r), r, name)
+}
+
+type StatusCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type StatusPageData struct {
+	PageTitle         string        `json:"-"`
+	Connections       int           `json:"connections"`
+	MaxConns          int           `json:"max_conns"`
+	RejectedConns     int64         `json:"rejected_conns"`
+	ConnsByIP         []StatusCount `json:"conns_by_ip"`
+	Downloads         int           `json:"downloads"`
+	MaxDownloads      int           `json:"max_downloads"`
+	QueuedDownloads   int           `json:"queued_downloads"`
+	DownloadsByClient []StatusCount `json:"downloads_by_client"`
+}
+
+// sortCounts orders m by count, highest first.
+func sortCounts(m map[string]int) ([]StatusCount, int) {
+	counts := []StatusCount{}
+	total := 0
+	for k, v := range m {
+		counts = append(counts, StatusCount{Key: k, Count: v})
+		total += v
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	return counts, total
+}
+
+func getStatus() StatusPageData {
+	data := StatusPageData{PageTitle: "status", MaxConns: goServMaxConns, MaxDownloads: goServMaxDownloads}
+	if connLimiter != nil {
+		byIP, rejected := connLimiter.counts()
+		data.ConnsByIP, data.Connections = sortCounts(byIP)
+		data.RejectedConns = rejected
+	}
+	if transferLimiter != nil {
+		byClient, queued := transferLimiter.counts()
+		data.DownloadsByClient, data.Downloads = sortCounts(byClient)
+		data.QueuedDownloads = queued
+	}
+	return data
+}
+
+// handleStatus shows the open connections and downloads on the admin
+// listener, as HTML or with ?format=json as JSON.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	data := getStatus()
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	tmpl := template.Must(template.ParseFS(embedded, "assets/templates/status.html"))
+	err := tmpl.Execute(w, data)
+	if err != nil {
+		slog.Error("template execute", "path", "status", "err", err)
+	}
+}
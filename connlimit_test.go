@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeListener hands out pipe connections that appear to come from addr.
+type fakeListener struct {
+	conns chan net.Conn
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func (l *fakeListener) dial(ip string) net.Conn {
+	server, client := net.Pipe()
+	l.conns <- addrConn{Conn: server, addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+	return client
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *fakeListener) Close() error   { return nil }
+func (l *fakeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestLimitListener(t *testing.T) {
+	fl := &fakeListener{conns: make(chan net.Conn, 8)}
+	cl := NewConnLimiter(2, 1)
+	ln := cl.limitListener(fl)
+	fl.dial("192.0.2.1")
+	fl.dial("192.0.2.1")
+	fl.dial("192.0.2.2")
+	fl.dial("192.0.2.3")
+	first, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second connection of 192.0.2.1 is closed, 192.0.2.2 accepted
+	second, err := ln.Accept()
+	if err != nil || second.RemoteAddr().(*net.TCPAddr).IP.String() != "192.0.2.2" {
+		t.Fatalf("got %v %v", second, err)
+	}
+	byIP, rejected := cl.counts()
+	if rejected != 1 || byIP["192.0.2.1"] != 1 || cl.open() != 2 {
+		t.Errorf("counts %v, rejected %d", byIP, rejected)
+	}
+	// at -max-conns the next Accept waits for a connection to close
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted over the total limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("not accepted after a close")
+	}
+	second.Close()
+	if n := cl.open(); n != 0 {
+		t.Errorf("%d connections left open", n)
+	}
+}
+
+func TestTransferLimiter(t *testing.T) {
+	tl := NewTransferLimiter(2, 1)
+	ctx := context.Background()
+	releaseA, err := tl.acquire(ctx, "a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second transfer of a waits, b goes past it into the free slot
+	grantedA := make(chan func())
+	go func() {
+		release, _ := tl.acquire(ctx, "a", time.Second)
+		grantedA <- release
+	}()
+	for {
+		if _, queued := tl.counts(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	releaseB, err := tl.acquire(ctx, "b", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("b blocked behind a: %v", err)
+	}
+	if _, err := tl.acquire(ctx, "c", 10*time.Millisecond); !errors.Is(err, errTransferQueueTimeout) {
+		t.Errorf("over the total limit: %v", err)
+	}
+	releaseA()
+	(<-grantedA)()
+	releaseB()
+	active, queued := tl.counts()
+	if len(active) != 0 || queued != 0 {
+		t.Errorf("left %v active, %d queued", active, queued)
+	}
+}
+
+func TestServeFileQueueTimeout(t *testing.T) {
+	setupServedDir(t, "a.txt")
+	savedLimiter, savedTimeout := transferLimiter, goServDownloadQueueTimeout
+	transferLimiter = NewTransferLimiter(1, 0)
+	goServDownloadQueueTimeout = 10 * time.Millisecond
+	defer func() { transferLimiter, goServDownloadQueueTimeout = savedLimiter, savedTimeout }()
+	release, err := transferLimiter.acquire(context.Background(), "other", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/", http.HandlerFunc(handlePath))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/a.txt", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	release()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/a.txt", nil))
+	if w.Body.String() != "content" {
+		t.Errorf("after release: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestServeFileQueuedPastWriteTimeout(t *testing.T) {
+	setupServedDir(t, "a.txt")
+	savedLimiter, savedTimeout := transferLimiter, goServDownloadQueueTimeout
+	transferLimiter = NewTransferLimiter(1, 0)
+	goServDownloadQueueTimeout = 5 * time.Second
+	defer func() { transferLimiter, goServDownloadQueueTimeout = savedLimiter, savedTimeout }()
+	release, err := transferLimiter.acquire(context.Background(), "other", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.StripPrefix("/", http.HandlerFunc(handlePath)))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	// the slot frees up well after the WriteTimeout has passed
+	time.AfterFunc(300*time.Millisecond, release)
+	res, err := http.Get(srv.URL + "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil || string(body) != "content" {
+		t.Errorf("got %d %q: %v", res.StatusCode, body, err)
+	}
+}
+
+func TestStatusAdmin(t *testing.T) {
+	savedConns, savedTransfers, savedToken := connLimiter, transferLimiter, goServAdminToken
+	connLimiter = NewConnLimiter(0, 0)
+	transferLimiter = NewTransferLimiter(0, 0)
+	goServAdminToken = "s3cret"
+	defer func() { connLimiter, transferLimiter, goServAdminToken = savedConns, savedTransfers, savedToken }()
+	connLimiter.admit("192.0.2.1")
+	connLimiter.admit("192.0.2.1")
+	release, _ := transferLimiter.acquire(context.Background(), "ip:192.0.2.1", time.Second)
+	defer release()
+	get := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		adminMux.ServeHTTP(w, r)
+		return w
+	}
+	var data StatusPageData
+	w := get("/status?format=json")
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("%d %s", w.Code, w.Body.String())
+	}
+	if data.Connections != 2 || data.ConnsByIP[0].Key != "192.0.2.1" || data.Downloads != 1 {
+		t.Errorf("json: %+v", data)
+	}
+	if w := get("/status"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("html: %d", w.Code)
+	}
+}
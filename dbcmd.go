@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExportRecord is a watched record together with its path, as written by
+// `goserv db export` and read by `goserv db import`.
+type ExportRecord struct {
+	Path string `json:"path"`
+	WatchRecord
+}
+
+type ExportFile struct {
+	SchemaVersion int            `json:"schema_version"`
+	Exported      time.Time      `json:"exported"`
+	Records       []ExportRecord `json:"records"`
+}
+
+var csvHeader = []string{"path", "first_seen", "last_seen", "count", "max_offset", "size", "user", "watched", "dir"}
+
+func exportJSON(w io.Writer, records []ExportRecord) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ExportFile{
+		SchemaVersion: latestSchemaVersion(),
+		Exported:      time.Now().UTC(),
+		Records:       records,
+	})
+}
+
+func exportCSV(w io.Writer, records []ExportRecord) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		err = cw.Write([]string{
+			r.Path,
+			r.FirstSeen.Format(time.RFC3339),
+			r.LastSeen.Format(time.RFC3339),
+			strconv.Itoa(r.Count),
+			strconv.FormatInt(r.MaxOffset, 10),
+			strconv.FormatInt(r.Size, 10),
+			r.User,
+			strconv.FormatBool(r.Watched),
+			strconv.FormatBool(r.Dir),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func importJSON(r io.Reader) ([]ExportRecord, error) {
+	var f ExportFile
+	err := json.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return nil, err
+	}
+	return f.Records, nil
+}
+
+func importCSV(r io.Reader) ([]ExportRecord, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(csvHeader, ",") {
+		return nil, fmt.Errorf("csv header must be %s", strings.Join(csvHeader, ","))
+	}
+	var records []ExportRecord
+	for i, row := range rows[1:] {
+		var rec ExportRecord
+		rec.Path = row[0]
+		rec.FirstSeen, err = time.Parse(time.RFC3339, row[1])
+		if err == nil {
+			rec.LastSeen, err = time.Parse(time.RFC3339, row[2])
+		}
+		if err == nil {
+			rec.Count, err = strconv.Atoi(row[3])
+		}
+		if err == nil {
+			rec.MaxOffset, err = strconv.ParseInt(row[4], 10, 64)
+		}
+		if err == nil {
+			rec.Size, err = strconv.ParseInt(row[5], 10, 64)
+		}
+		rec.User = row[6]
+		if err == nil {
+			rec.Watched, err = strconv.ParseBool(row[7])
+		}
+		if err == nil {
+			rec.Dir, err = strconv.ParseBool(row[8])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d: %w", i+2, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// mergeRecords combines an imported record with an existing one, keeping
+// the widest span of history from both.
+func mergeRecords(cur WatchRecord, in WatchRecord) WatchRecord {
+	if cur.FirstSeen.IsZero() || (!in.FirstSeen.IsZero() && in.FirstSeen.Before(cur.FirstSeen)) {
+		cur.FirstSeen = in.FirstSeen
+	}
+	if in.LastSeen.After(cur.LastSeen) {
+		cur.LastSeen = in.LastSeen
+		if in.User != "" {
+			cur.User = in.User
+		}
+	}
+	if in.Count > cur.Count {
+		cur.Count = in.Count
+	}
+	if in.MaxOffset > cur.MaxOffset {
+		cur.MaxOffset = in.MaxOffset
+	}
+	if in.Size > 0 {
+		cur.Size = in.Size
+	}
+	cur.Watched = cur.Watched || in.Watched
+	cur.Dir = cur.Dir || in.Dir
+	if cur.ID == "" {
+		cur.ID = in.ID
+	}
+	return cur
+}
+
+func getFormat(format string, name string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+func dbExport(args []string) error {
+	fs := flag.NewFlagSet("db export", flag.ExitOnError)
+	format := fs.String("format", "", "json or csv, defaults by output file extension")
+	out := fs.String("o", "-", "output file, - for stdout")
+	_ = fs.Parse(args)
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return GetBoltInstance().dump(w, getFormat(*format, *out))
+}
+
+func dbImport(args []string) error {
+	fs := flag.NewFlagSet("db import", flag.ExitOnError)
+	format := fs.String("format", "", "json or csv, defaults by input file extension")
+	mode := fs.String("mode", "merge", "merge into or replace the existing records")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: goserv db import [-format json|csv] [-mode merge|replace] file")
+	}
+	if *mode != "merge" && *mode != "replace" {
+		return fmt.Errorf("unknown import mode %q", *mode)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var records []ExportRecord
+	switch getFormat(*format, fs.Arg(0)) {
+	case "csv":
+		records, err = importCSV(f)
+	case "json":
+		records, err = importJSON(f)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+	err = GetBoltInstance().load(records, *mode == "replace")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d records\n", len(records))
+	return nil
+}
+
+func dbBackup(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: goserv db backup file")
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return fmt.Errorf("%s already exists", args[0])
+	}
+	db, err := GetBoltInstance().boltDB()
+	if err != nil {
+		return err
+	}
+	return backupBolt(db, args[0])
+}
+
+func dbCompact(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: goserv db compact file")
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return fmt.Errorf("%s already exists", args[0])
+	}
+	src, err := GetBoltInstance().boltDB()
+	if err != nil {
+		return err
+	}
+	dst, err := bolt.Open(args[0], 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	err = bolt.Compact(dst, src, 64*1024*1024)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := os.Stat(src.Path())
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("compacted %d -> %d bytes\n", srcInfo.Size(), dstInfo.Size())
+	return nil
+}
+
+// gcKeys removes records, aggregates and identities whose path no longer
+// exists below goServDir and returns the number of pruned keys.
+func gcKeys(tx StoreTx, dryRun bool) (int, error) {
+	exists := map[string]bool{".": true}
+	check := func(key string) bool {
+		ok, seen := exists[key]
+		if !seen {
+			_, err := os.Lstat(filepath.Join(goServDir, key))
+			ok = err == nil
+			exists[key] = ok
+		}
+		return ok
+	}
+	pruned := 0
+	for _, name := range []string{watchedBucket, dirStatsBucket, identityBucket, positionBucket} {
+		var stale []string
+		err := tx.Iterate(name, "", func(k string, v []byte) error {
+			key := k
+			switch name {
+			case identityBucket:
+				l, _ := decodeIdentityLink(v)
+				key = l.Path
+			case positionBucket:
+				_, key, _ = strings.Cut(k, "\x00")
+			}
+			if !check(key) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if name == watchedBucket {
+			pruned = len(stale)
+		}
+		if dryRun {
+			for _, k := range stale {
+				if name == watchedBucket {
+					fmt.Println(k)
+				}
+			}
+			continue
+		}
+		for _, k := range stale {
+			err = tx.Delete(name, k)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if dryRun {
+		return pruned, nil
+	}
+	return pruned, rebuildDirStats(tx)
+}
+
+func dbGC(args []string) error {
+	fs := flag.NewFlagSet("db gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list the stale paths without removing them")
+	_ = fs.Parse(args)
+	var pruned int
+	store := GetBoltInstance().store
+	run := store.Update
+	if *dryRun {
+		run = store.View
+	}
+	err := run(context.Background(), func(tx StoreTx) error {
+		var err error
+		pruned, err = gcKeys(tx, *dryRun)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%d stale records below %s\n", pruned, goServDir)
+	} else {
+		fmt.Printf("pruned %d stale records below %s\n", pruned, goServDir)
+	}
+	return nil
+}
+
+func dbAudit(args []string) error {
+	fs := flag.NewFlagSet("db audit", flag.ExitOnError)
+	q := url.Values{}
+	for _, name := range []string{"user", "basic_user", "path", "action", "since", "until", "limit"} {
+		fs.Func(name, "only events matching this "+name, func(v string) error {
+			q.Set(name, v)
+			return nil
+		})
+	}
+	format := fs.String("format", "csv", "output format: csv or json")
+	prune := fs.Duration("prune", 0, "instead of querying, remove events older than this")
+	_ = fs.Parse(args)
+	if *prune > 0 {
+		n, err := pruneAudit(time.Now(), *prune)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pruned %d audit events\n", n)
+		return nil
+	}
+	f, err := parseAuditFilter(q, time.Now())
+	if err != nil {
+		return err
+	}
+	events, err := queryAudit(f)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "csv":
+		return writeAuditCSV(os.Stdout, events)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+// runDBCommand implements `goserv db <command>`, run against the database
+// given by -db. The server must not hold the database open; use the admin
+// /backup endpoint for backups of a running instance.
+func runDBCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: goserv db export|import|backup|compact|gc|audit")
+	}
+	switch args[0] {
+	case "export":
+		return dbExport(args[1:])
+	case "import":
+		return dbImport(args[1:])
+	case "backup":
+		return dbBackup(args[1:])
+	case "compact":
+		return dbCompact(args[1:])
+	case "gc":
+		return dbGC(args[1:])
+	case "audit":
+		return dbAudit(args[1:])
+	}
+	return fmt.Errorf("unknown db command %q", args[0])
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var exportFixture = []ExportRecord{
+	{Path: "export/a.mkv", WatchRecord: WatchRecord{
+		FirstSeen: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		LastSeen:  time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		Count:     2, MaxOffset: 10, Size: 20, User: "alice", Watched: true,
+	}},
+	{Path: "export/b,\"quoted\".mkv", WatchRecord: WatchRecord{
+		FirstSeen: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		LastSeen:  time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		Count:     1,
+	}},
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	var tests = []struct {
+		name string
+		exp  func(*bytes.Buffer, []ExportRecord) error
+		imp  func(*bytes.Buffer) ([]ExportRecord, error)
+	}{
+		{"json",
+			func(b *bytes.Buffer, r []ExportRecord) error { return exportJSON(b, r) },
+			func(b *bytes.Buffer) ([]ExportRecord, error) { return importJSON(b) }},
+		{"csv",
+			func(b *bytes.Buffer, r []ExportRecord) error { return exportCSV(b, r) },
+			func(b *bytes.Buffer) ([]ExportRecord, error) { return importCSV(b) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := tt.exp(&buf, exportFixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.imp(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, exportFixture) {
+				t.Fatalf("got %+v, want %+v", got, exportFixture)
+			}
+		})
+	}
+}
+
+func TestLoadMerge(t *testing.T) {
+	bolton := GetBoltInstance()
+	err := bolton.progress("export/a.mkv", WatchHit{Offset: 15, Size: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bolton.load(exportFixture, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := bolton.getRecord("export/a.mkv")
+	if !rec.Watched || rec.MaxOffset != 15 || !rec.FirstSeen.Equal(exportFixture[0].FirstSeen) {
+		t.Fatalf("unexpected merged record %+v", rec)
+	}
+	if _, ok := bolton.getRecord("export/b,\"quoted\".mkv"); !ok {
+		t.Fatalf("imported record missing")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "compact.db")
+	err := runDBCommand([]string{"compact", dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runDBCommand([]string{"compact", dst}); err == nil {
+		t.Fatalf("compact overwrote an existing file")
+	}
+}
+
+func TestBackupEndpoint(t *testing.T) {
+	saved := goServAdminToken
+	defer func() { goServAdminToken = saved }()
+	h := requireAdminToken(http.HandlerFunc(handleBackup))
+
+	goServAdminToken = ""
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/backup", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("without configured token: got %d", w.Code)
+	}
+
+	goServAdminToken = "s3cret"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/backup", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("without credentials: got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/backup", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("with token: got %d", w.Code)
+	}
+	name := filepath.Join(t.TempDir(), "backup.db")
+	err := os.WriteFile(name, w.Body.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(name, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(watchedBucket)) == nil {
+			t.Errorf("backup is missing the watched bucket")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
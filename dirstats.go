@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// DirStats is the per-directory aggregate kept in the dirstats bucket.
+// Watched is maintained incrementally whenever a file below the directory
+// changes state. Total is counted by a walk that is only repeated once
+// goserv has changed the tree below the directory after Scanned, which
+// sets Changed, or the directory itself was modified.
+type DirStats struct {
+	Watched int       `json:"watched"`
+	Total   int       `json:"total"`
+	Scanned time.Time `json:"scanned"`
+	Changed time.Time `json:"changed,omitempty"`
+}
+
+// parentKeys returns the keys of every directory containing key, nearest
+// first, ending with the root ".".
+func parentKeys(key string) []string {
+	var keys []string
+	for key != "." && key != "" {
+		key = path.Dir(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func getDirStats(tx StoreTx, key string) DirStats {
+	var ds DirStats
+	v := tx.Get(dirStatsBucket, key)
+	if v != nil {
+		_ = json.Unmarshal(v, &ds)
+	}
+	return ds
+}
+
+func putDirStats(tx StoreTx, key string, ds DirStats) error {
+	v, err := json.Marshal(ds)
+	if err != nil {
+		return err
+	}
+	return tx.Put(dirStatsBucket, key, v)
+}
+
+// adjustDirCounts adds delta to the watched count of every directory above
+// the file key.
+func adjustDirCounts(tx StoreTx, key string, delta int) error {
+	for _, dir := range parentKeys(key) {
+		ds := getDirStats(tx, dir)
+		ds.Watched += delta
+		if ds.Watched < 0 {
+			ds.Watched = 0
+		}
+		err := putDirStats(tx, dir, ds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markDirsChanged marks the totals of every directory above the entries
+// keys stale. Every change goserv makes to the served tree goes through
+// here, so listings never walk subdirectories to find out.
+func markDirsChanged(tx StoreTx, now time.Time, keys ...string) error {
+	for _, key := range keys {
+		for _, dir := range parentKeys(key) {
+			ds := getDirStats(tx, dir)
+			if ds.Scanned.IsZero() {
+				// never counted, nothing to invalidate
+				continue
+			}
+			ds.Changed = now
+			err := putDirStats(tx, dir, ds)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dirsChanged runs markDirsChanged for entries goserv created.
+func dirsChanged(keys ...string) {
+	err := GetBoltInstance().store.Update(context.Background(), func(tx StoreTx) error {
+		return markDirsChanged(tx, time.Now(), keys...)
+	})
+	if err != nil {
+		slog.Error("dir stats", "paths", keys, "err", err)
+	}
+}
+
+// rebuildDirStats recomputes the watched counts from the records in
+// the watched bucket, keeping the cached totals.
+func rebuildDirStats(tx StoreTx) error {
+	counts := map[string]int{}
+	err := tx.Iterate(dirStatsBucket, "", func(k string, v []byte) error {
+		counts[k] = 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Iterate(watchedBucket, "", func(k string, v []byte) error {
+		rec, ok := decodeRecord(v)
+		if ok && rec.Watched && !rec.Dir {
+			for _, dir := range parentKeys(k) {
+				counts[dir]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for dir, n := range counts {
+		ds := getDirStats(tx, dir)
+		ds.Watched = n
+		err = putDirStats(tx, dir, ds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countFiles walks a directory and counts the files below it.
+func countFiles(name string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if goIgnoreFiles.Contains(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// getDirProgress returns "watched/total" for a directory, or "" when
+// nothing below it has been watched.
+func getDirProgress(name string, key string) string {
+	bolton := GetBoltInstance()
+	var ds DirStats
+	err := bolton.store.View(context.Background(), func(tx StoreTx) error {
+		ds = getDirStats(tx, key)
+		return nil
+	})
+	if err != nil || ds.Watched == 0 {
+		return ""
+	}
+	// the directory's own time catches files added or removed in it by
+	// something other than goserv
+	fi, err := os.Stat(name)
+	if err != nil {
+		return ""
+	}
+	if ds.Scanned.IsZero() || ds.Changed.After(ds.Scanned) || fi.ModTime().After(ds.Scanned) {
+		// a change during the walk leaves Changed after Scanned
+		scanned := time.Now()
+		total, err := countFiles(name)
+		if err != nil {
+			slog.Warn("count files", "dir", name, "err", err)
+			return ""
+		}
+		err = bolton.store.Update(context.Background(), func(tx StoreTx) error {
+			cur := getDirStats(tx, key)
+			cur.Total = total
+			cur.Scanned = scanned
+			ds = cur
+			return putDirStats(tx, key, cur)
+		})
+		if err != nil {
+			slog.Error("dir stats", "dir", key, "err", err)
+		}
+	}
+	watched := ds.Watched
+	if watched > ds.Total {
+		watched = ds.Total
+	}
+	return fmt.Sprintf("%d/%d", watched, ds.Total)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParentKeys(t *testing.T) {
+	var tests = []struct {
+		key  string
+		want []string
+	}{
+		{"a/b/c.mkv", []string{"a/b", "a", "."}},
+		{"c.mkv", []string{"."}},
+		{".", nil},
+	}
+	for _, tt := range tests {
+		if got := parentKeys(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestDirProgress(t *testing.T) {
+	dir := t.TempDir()
+	show := filepath.Join(dir, "progress-show")
+	err := os.Mkdir(show, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		err = os.WriteFile(filepath.Join(show, fmt.Sprintf("e%02d.mkv", i)), []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bolton := GetBoltInstance()
+	if got := getDirProgress(show, "progress-show"); got != "" {
+		t.Fatalf("untouched dir shows %q", got)
+	}
+	for i := 1; i <= 9; i++ {
+		err = bolton.progress(fmt.Sprintf("progress-show/e%02d.mkv", i), WatchHit{Watched: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// watching a file twice must not count it twice
+	err = bolton.update("progress-show/e01.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getDirProgress(show, "progress-show"); got != "9/10" {
+		t.Fatalf("got %q, want 9/10", got)
+	}
+	err = bolton.delete("progress-show/e02.mkv", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getDirProgress(show, "progress-show"); got != "8/10" {
+		t.Fatalf("got %q, want 8/10", got)
+	}
+	// a file added to a subdirectory changes only that directory's mtime:
+	// listings do not walk to find it, the write that adds it tells them
+	extras := filepath.Join(show, "extras")
+	err = os.Mkdir(extras, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getDirProgress(show, "progress-show"); got != "8/10" {
+		t.Fatalf("got %q, want 8/10", got)
+	}
+	err = os.WriteFile(filepath.Join(extras, "trailer.mkv"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(extras, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getDirProgress(show, "progress-show"); got != "8/10" {
+		t.Fatalf("got %q, want the cached 8/10", got)
+	}
+	dirsChanged("progress-show/extras/trailer.mkv")
+	if got := getDirProgress(show, "progress-show"); got != "8/11" {
+		t.Fatalf("got %q, want 8/11", got)
+	}
+	err = bolton.delete("progress-show", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getDirProgress(show, "progress-show"); got != "" {
+		t.Fatalf("got %q after unmarking everything", got)
+	}
+}
+
+func TestDirProgressFollowsWrites(t *testing.T) {
+	dir := setupServedDir(t, "stats/show/e01.mkv", "stats/show/e02.mkv")
+	withUploads(t, 0, 0, "stats")
+	withManage(t, ".")
+	err := GetBoltInstance().update("stats/show/e01.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := func() string {
+		return getDirProgress(filepath.Join(dir, "stats"), "stats")
+	}
+	if got := progress(); got != "1/2" {
+		t.Fatalf("got %q, want 1/2", got)
+	}
+	var steps = []struct {
+		name  string
+		write func() error
+		want  string
+	}{
+		{"upload", func() error {
+			if w := postUpload(t, "stats/show", map[string]string{"e03.mkv": "x"}); w.Code != http.StatusOK {
+				return fmt.Errorf("upload: %d", w.Code)
+			}
+			return nil
+		}, "1/3"},
+		{"trash", func() error {
+			_, err := trashEntry("stats/show/e02.mkv", time.Now())
+			return err
+		}, "1/2"},
+		{"move out", func() error {
+			_, err := moveToDir("stats/show/e03.mkv", ".")
+			return err
+		}, "1/1"},
+	}
+	for _, s := range steps {
+		if err := s.write(); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if got := progress(); got != s.want {
+			t.Errorf("%s: got %q, want %s", s.name, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const feedMaxEntries = 50
+
+type FeedItem struct {
+	Name     string
+	Href     string
+	Type     string
+	Size     int64
+	Modified time.Time
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	Link      string       `xml:"link"`
+	GUID      string       `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+// populateFeedItems lists the regular files of a directory, newest first.
+func populateFeedItems(name string, upath string) []FeedItem {
+	files, err := os.ReadDir(name)
+	if err != nil {
+		slog.Error("read dir", "dir", name, "err", err)
+	}
+	var items []FeedItem
+	for _, file := range files {
+		if file.IsDir() || goIgnoreFiles.Contains(file.Name()) {
+			continue
+		}
+		finfo, err := file.Info()
+		if err != nil || !finfo.Mode().IsRegular() {
+			continue
+		}
+		ctype := mime.TypeByExtension(filepath.Ext(file.Name()))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		items = append(items, FeedItem{
+			Name:     file.Name(),
+			Href:     getHref(file, upath),
+			Type:     ctype,
+			Size:     finfo.Size(),
+			Modified: finfo.ModTime(),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Modified.After(items[j].Modified)
+	})
+	if len(items) > feedMaxEntries {
+		items = items[:feedMaxEntries]
+	}
+	return items
+}
+
+func getBaseURL(r *http.Request) string {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/", scheme, r.Host)
+}
+
+func getFeedTitle(upath string) string {
+	if upath == "." {
+		return "goserv"
+	}
+	return "goserv: " + upath
+}
+
+func serveFeed(w http.ResponseWriter, r *http.Request, name string, upath string, format string) {
+	base := getBaseURL(r)
+	self := base
+	if upath != "." {
+		self = base + url.PathEscape(upath)
+	}
+	items := populateFeedItems(name, upath)
+	updated := time.Unix(0, 0).UTC()
+	if len(items) > 0 {
+		updated = items[0].Modified.UTC()
+	}
+
+	var doc any
+	switch format {
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		channel := rssChannel{
+			Title:         getFeedTitle(upath),
+			Link:          self,
+			Description:   "Files in " + getFeedTitle(upath),
+			LastBuildDate: updated.Format(time.RFC1123Z),
+		}
+		for _, item := range items {
+			href := base + item.Href
+			channel.Items = append(channel.Items, rssItem{
+				Title:   item.Name,
+				Link:    href,
+				GUID:    href,
+				PubDate: item.Modified.UTC().Format(time.RFC1123Z),
+				Enclosure: rssEnclosure{
+					URL:    href,
+					Length: item.Size,
+					Type:   item.Type,
+				},
+			})
+		}
+		doc = rssFeed{Version: "2.0", Channel: channel}
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		feed := atomFeed{
+			Title:   getFeedTitle(upath),
+			ID:      self,
+			Updated: updated.Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: self + "?format=atom", Rel: "self", Type: "application/atom+xml"},
+				{Href: self, Rel: "alternate", Type: "text/html"},
+			},
+		}
+		for _, item := range items {
+			href := base + item.Href
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   item.Name,
+				ID:      href,
+				Updated: item.Modified.UTC().Format(time.RFC3339),
+				Links: []atomLink{
+					{Href: href, Rel: "alternate"},
+					{Href: href, Rel: "enclosure", Type: item.Type, Length: item.Size},
+				},
+			})
+		}
+		doc = feed
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err := w.Write([]byte(xml.Header))
+	if err != nil {
+		return
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		slog.Error("feed encode", "path", upath, "err", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeFeedRSS(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://localhost/testdata/dir?format=rss", nil)
+	w := httptest.NewRecorder()
+	serveFeed(w, r, "testdata/dir", "testdata/dir", "rss")
+	var feed rssFeed
+	err := xml.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Channel.Items) != 2 {
+		t.Fatalf("want 2 items, got %d", len(feed.Channel.Items))
+	}
+	for _, item := range feed.Channel.Items {
+		if !strings.HasPrefix(item.Enclosure.URL, "http://localhost/testdata%2Fdir%2Ffile") {
+			t.Errorf("unexpected enclosure url %s", item.Enclosure.URL)
+		}
+		if item.Enclosure.Length == 0 {
+			t.Errorf("missing enclosure length for %s", item.Title)
+		}
+	}
+}
+
+func TestServeFeedAtom(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://localhost/testdata/dir?format=atom", nil)
+	w := httptest.NewRecorder()
+	serveFeed(w, r, "testdata/dir", "testdata/dir", "atom")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	var feed atomFeed
+	err := xml.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != 2 {
+		t.Fatalf("want 2 entries, got %d", len(feed.Entries))
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// trashDir holds deleted entries below goServDir until -trash-retention
+// has passed. It is on the same filesystem, so deleting is a rename.
+const trashDir = ".goserv-trash"
+
+// fileOps are the operations a -manage rule can grant. Moving an entry
+// needs rename in both directories.
+var fileOps = []string{"mkdir", "rename", "delete"}
+
+var (
+	errManageDenied = errors.New("not permitted in this directory")
+	errMoveInto     = errors.New("cannot move a directory into itself")
+)
+
+// isServerDir reports whether key lies in a directory goserv keeps for
+// itself below goServDir: upload staging, the trash and the thumbnail
+// cache.
+func isServerDir(key string) bool {
+	for _, dir := range []string{trashDir, thumbCacheDir} {
+		if key == dir || strings.HasPrefix(key, dir+"/") {
+			return true
+		}
+	}
+	return isUploadStaging(key)
+}
+
+// isHiddenKey reports whether any element of key is hidden by -ignore or
+// key lies in a directory goserv keeps for itself, for the views that
+// serve arbitrary paths below a root: WebDAV and shares.
+func isHiddenKey(key string) bool {
+	if key == "." {
+		return false
+	}
+	if isServerDir(key) {
+		return true
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if goIgnoreFiles.Contains(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseManageRule splits a -manage rule, dir=op,op or a bare dir granting
+// every operation.
+func parseManageRule(rule string) (string, map[string]bool, error) {
+	dir, list, found := strings.Cut(rule, "=")
+	if !found {
+		list = "all"
+	}
+	ops := map[string]bool{}
+	for _, op := range strings.Split(list, ",") {
+		op = strings.TrimSpace(op)
+		switch {
+		case op == "":
+		case op == "all":
+			for _, o := range fileOps {
+				ops[o] = true
+			}
+		case op == "mkdir" || op == "rename" || op == "delete":
+			ops[op] = true
+		default:
+			return "", nil, fmt.Errorf("-manage %s: unknown operation %q", rule, op)
+		}
+	}
+	return cleanKey(dir), ops, nil
+}
+
+// getManageOps returns the operations allowed in the directory key by the
+// most specific -manage rule covering it, so -manage media -manage
+// media/archive= leaves media/archive untouchable.
+func getManageOps(key string) map[string]bool {
+	best := -1
+	var ops map[string]bool
+	for _, rule := range goServManage {
+		dir, rops, err := parseManageRule(rule)
+		if err != nil || !inScope(key, dir) {
+			continue
+		}
+		n := len(dir)
+		if dir == "." {
+			n = 0
+		}
+		if n >= best {
+			best, ops = n, rops
+		}
+	}
+	return ops
+}
+
+// canManage reports whether op is allowed in the directory key.
+func canManage(key string, op string) bool {
+	return !isServerDir(key) && getManageOps(key)[op]
+}
+
+// resolveManagedDir resolves the directory key through symlinks and checks
+// that op is allowed both where the request points and where the path
+// really leads.
+func resolveManagedDir(key string, op string) (string, error) {
+	if !canManage(key, op) {
+		return "", errManageDenied
+	}
+	dir, rel, err := resolveServedDir(key)
+	if errors.Is(err, errOutsideRoot) {
+		return "", errManageDenied
+	}
+	if err != nil {
+		return "", err
+	}
+	if !canManage(rel, op) {
+		return "", errManageDenied
+	}
+	return dir, nil
+}
+
+// resolveManagedEntry returns the path of the existing entry key after
+// checking op in its directory.
+func resolveManagedEntry(key string, op string) (string, error) {
+	if key == "." || isServerDir(key) {
+		return "", errManageDenied
+	}
+	dir, err := resolveManagedDir(path.Dir(key), op)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, path.Base(key))
+	_, err = os.Lstat(name)
+	return name, err
+}
+
+func makeDir(key string, name string) (string, error) {
+	dir, err := resolveManagedDir(key, "mkdir")
+	if err != nil {
+		return "", err
+	}
+	name, err = sanitizeFilename(name)
+	if err != nil {
+		return "", err
+	}
+	err = os.Mkdir(filepath.Join(dir, name), 0755)
+	if errors.Is(err, fs.ErrExist) {
+		return "", errUploadExists
+	}
+	if err != nil {
+		return "", err
+	}
+	dirsChanged(getKey(key, name))
+	return getKey(key, name), nil
+}
+
+// moveEntry renames the entry key to the entry target, never replacing an
+// existing one, and moves its watched state along.
+func moveEntry(key string, src string, target string, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return errUploadExists
+	}
+	err := os.Rename(src, dst)
+	if err != nil {
+		return err
+	}
+	err = GetBoltInstance().rename(key, target)
+	if err != nil {
+		slog.Warn("rename watched", "from", key, "to", target, "err", err)
+	}
+	return nil
+}
+
+func renameEntry(key string, name string) (string, error) {
+	src, err := resolveManagedEntry(key, "rename")
+	if err != nil {
+		return "", err
+	}
+	name, err = sanitizeFilename(name)
+	if err != nil {
+		return "", err
+	}
+	target := getKey(path.Dir(key), name)
+	if target == key {
+		return target, nil
+	}
+	return target, moveEntry(key, src, target, filepath.Join(filepath.Dir(src), name))
+}
+
+func moveToDir(key string, destDir string) (string, error) {
+	if inScope(destDir, key) {
+		return "", errMoveInto
+	}
+	src, err := resolveManagedEntry(key, "rename")
+	if err != nil {
+		return "", err
+	}
+	dir, err := resolveManagedDir(destDir, "rename")
+	if err != nil {
+		return "", err
+	}
+	target := getKey(destDir, path.Base(key))
+	if target == key {
+		return target, nil
+	}
+	return target, moveEntry(key, src, target, filepath.Join(dir, path.Base(key)))
+}
+
+// trashEntry moves the entry key into a new, time stamped directory of the
+// trash and forgets its watched state.
+func trashEntry(key string, now time.Time) (string, error) {
+	src, err := resolveManagedEntry(key, "delete")
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return "", err
+	}
+	bin := now.UTC().Format("20060102T150405Z") + "-" + randomHex(4)
+	dir := filepath.Join(goServDir, trashDir, bin)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(src, filepath.Join(dir, path.Base(key)))
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	dirsChanged(key)
+	err = GetBoltInstance().delete(key, fi.IsDir())
+	if err != nil {
+		slog.Warn("forget deleted", "path", key, "err", err)
+	}
+	return trashDir + "/" + bin + "/" + path.Base(key), nil
+}
+
+// purgeTrash removes the trash directories older than retention.
+func purgeTrash(now time.Time, retention time.Duration) error {
+	entries, err := os.ReadDir(filepath.Join(goServDir, trashDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		stamp, _, _ := strings.Cut(e.Name(), "-")
+		t, err := time.Parse("20060102T150405Z", stamp)
+		if err != nil || now.Sub(t) < retention {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(goServDir, trashDir, e.Name()))
+		if err != nil {
+			return err
+		}
+		slog.Info("purged trash", "dir", e.Name())
+	}
+	return nil
+}
+
+func fileStatus(err error) int {
+	switch {
+	case errors.Is(err, errManageDenied):
+		return http.StatusForbidden
+	case errors.Is(err, errMoveInto):
+		return http.StatusBadRequest
+	}
+	return uploadStatus(err)
+}
+
+// handleFilesAPI creates directories and renames, moves and deletes
+// entries, as allowed by -manage. Every change lands in the audit bucket.
+func handleFilesAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "files")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	p, err := url.PathUnescape(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	key := cleanKey(p)
+	var target string
+	action := r.FormValue("action")
+	switch action {
+	case "mkdir":
+		target, err = makeDir(key, r.FormValue("name"))
+	case "rename":
+		target, err = renameEntry(key, r.FormValue("name"))
+	case "move":
+		var dest string
+		dest, err = url.PathUnescape(r.FormValue("dest"))
+		if err == nil {
+			target, err = moveToDir(key, cleanKey(dest))
+		}
+	case "delete":
+		target, err = trashEntry(key, time.Now())
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		status := fileStatus(err)
+		if status == http.StatusInternalServerError {
+			slog.Error("files api", "action", action, "path", key, "err", err)
+			http.Error(w, "Internal server error", status)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	slog.Info("files api", "action", action, "path", key, "target", target, "user", getRequestUser(r))
+	err = recordAudit(r, action, key, target)
+	if err != nil {
+		slog.Error("audit", "action", action, "path", key, "err", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"action": action,
+		"path":   key,
+		"target": target,
+	})
+}
+
+// startFileManagement validates -manage, hides the trash from listings and
+// purges it periodically.
+func startFileManagement() error {
+	if len(goServManage) == 0 {
+		return nil
+	}
+	for _, rule := range goServManage {
+		_, _, err := parseManageRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	if !goIgnoreFiles.Contains(trashDir) {
+		goIgnoreFiles = append(goIgnoreFiles, trashDir)
+	}
+	go func() {
+		for {
+			err := purgeTrash(time.Now(), goServTrashRetention)
+			if err != nil {
+				slog.Warn("purge trash", "err", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withManage(t *testing.T, rules ...string) {
+	t.Helper()
+	saved := goServManage
+	goServManage = rules
+	t.Cleanup(func() { goServManage = saved })
+}
+
+func TestCanManage(t *testing.T) {
+	withManage(t, "media", "media/archive=", "inbox=mkdir,rename", ".=delete")
+	var tests = []struct {
+		key  string
+		op   string
+		want bool
+	}{
+		{"media", "delete", true},
+		{"media/show", "mkdir", true},
+		{"media/archive", "rename", false},
+		{"media/archive/old", "delete", false},
+		{"inbox", "rename", true},
+		{"inbox", "delete", false},
+		{"other", "delete", true},
+		{"other", "mkdir", false},
+		{trashDir, "delete", false},
+		{uploadStagingDir + "/x", "delete", false},
+	}
+	for _, tt := range tests {
+		if got := canManage(tt.key, tt.op); got != tt.want {
+			t.Errorf("canManage(%q, %q) = %v, want %v", tt.key, tt.op, got, tt.want)
+		}
+	}
+	if _, _, err := parseManageRule("media=chmod"); err == nil {
+		t.Errorf("unknown operation accepted")
+	}
+}
+
+func postFiles(t *testing.T, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	form.Set("csrf", "t0ken")
+	r := httptest.NewRequest("POST", "/_/api/files", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+	r.SetBasicAuth("alice", "")
+	w := httptest.NewRecorder()
+	handleFilesAPI(w, r)
+	return w
+}
+
+func TestFilesAPI(t *testing.T) {
+	dir := setupServedDir(t, "media/show/e01.mkv", "media/show/e02.mkv", "media/archive/old.mkv", "other/x.txt")
+	withManage(t, "media", "media/archive=")
+	bolton := GetBoltInstance()
+	err := bolton.update("media/show/e01.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps = []struct {
+		name   string
+		form   url.Values
+		want   int
+		target string
+	}{
+		{"mkdir", url.Values{"action": {"mkdir"}, "path": {"media"}, "name": {"season 2"}}, http.StatusOK, "media/season 2"},
+		{"mkdir exists", url.Values{"action": {"mkdir"}, "path": {"media"}, "name": {"season 2"}}, http.StatusConflict, ""},
+		{"mkdir bad name", url.Values{"action": {"mkdir"}, "path": {"media"}, "name": {".."}}, http.StatusBadRequest, ""},
+		{"mkdir denied", url.Values{"action": {"mkdir"}, "path": {"other"}, "name": {"x"}}, http.StatusForbidden, ""},
+		{"rename", url.Values{"action": {"rename"}, "path": {"media%2Fshow%2Fe01.mkv"}, "name": {"pilot.mkv"}}, http.StatusOK, "media/show/pilot.mkv"},
+		{"rename onto existing", url.Values{"action": {"rename"}, "path": {"media/show/pilot.mkv"}, "name": {"e02.mkv"}}, http.StatusConflict, ""},
+		{"rename escape", url.Values{"action": {"rename"}, "path": {"media/show/e02.mkv"}, "name": {"../../x.mkv"}}, http.StatusOK, "media/show/x.mkv"},
+		{"move", url.Values{"action": {"move"}, "path": {"media/show"}, "dest": {"media/season 2"}}, http.StatusOK, "media/season 2/show"},
+		{"move into itself", url.Values{"action": {"move"}, "path": {"media/season 2"}, "dest": {"media/season 2/show"}}, http.StatusBadRequest, ""},
+		{"move out of scope", url.Values{"action": {"move"}, "path": {"media/season 2/show"}, "dest": {"other"}}, http.StatusForbidden, ""},
+		{"delete denied", url.Values{"action": {"delete"}, "path": {"media/archive/old.mkv"}}, http.StatusForbidden, ""},
+		{"delete missing", url.Values{"action": {"delete"}, "path": {"media/nope"}}, http.StatusNotFound, ""},
+		{"unknown", url.Values{"action": {"chmod"}, "path": {"media"}}, http.StatusBadRequest, ""},
+	}
+	for _, s := range steps {
+		w := postFiles(t, s.form)
+		if w.Code != s.want {
+			t.Fatalf("%s: got %d, want %d: %s", s.name, w.Code, s.want, w.Body.String())
+		}
+		if s.target == "" {
+			continue
+		}
+		var res struct{ Target string }
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if res.Target != s.target {
+			t.Errorf("%s: target %q, want %q", s.name, res.Target, s.target)
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(s.target))); err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+	}
+	if len(bolton.get("media/season 2/show/pilot.mkv")) == 0 {
+		t.Errorf("watched state did not follow rename and move")
+	}
+
+	w := postFiles(t, url.Values{"action": {"delete"}, "path": {"media/season 2/show/pilot.mkv"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d", w.Code)
+	}
+	var res struct{ Target string }
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if !strings.HasPrefix(res.Target, trashDir+"/") {
+		t.Errorf("delete target %q", res.Target)
+	}
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(res.Target))); err != nil {
+		t.Errorf("not in trash: %v", err)
+	}
+	if len(bolton.get("media/season 2/show/pilot.mkv")) != 0 {
+		t.Errorf("watched state of deleted file kept")
+	}
+
+	var actions []string
+	err = bolton.store.Iterate(context.Background(), auditBucket, "", func(k string, v []byte) error {
+		var ev AuditEvent
+		json.Unmarshal(v, &ev)
+		if ev.BasicUser == "alice" && strings.HasPrefix(ev.Path, "media") {
+			actions = append(actions, ev.Action)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(actions, ","); !strings.HasSuffix(got, "mkdir,rename,rename,move,delete") {
+		t.Errorf("audit trail %s", got)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	dir := setupServedDir(t)
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, bin := range []string{"20260101T000000Z-aaaa", "20260228T000000Z-bbbb", "unrelated"} {
+		err := os.MkdirAll(filepath.Join(dir, trashDir, bin, "f"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := purgeTrash(now, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, trashDir))
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if strings.Join(left, " ") != "20260228T000000Z-bbbb unrelated" {
+		t.Errorf("left %v", left)
+	}
+}
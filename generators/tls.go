@@ -126,6 +126,9 @@ import (
 	"time"
 )
 
+// TLSProfileGenerated is when the cipher profile below was fetched.
+const TLSProfileGenerated = "{{ .Timestamp.UTC.Format "2006-01-02T15:04:05Z07:00" }}"
+
 var TLSConfig = &tls.Config{
 	MinVersion:               tls.VersionTLS12,
 	CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -2,7 +2,11 @@ module github.com/ruupert/goserv
 
 go 1.22.7
 
-require go.etcd.io/bbolt v1.3.11
+require (
+	github.com/mattn/go-sqlite3 v1.14.24
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.27.0
+)
 
 require (
 	github.com/grafana/pyroscope-go/godeltaprof v0.1.8 // indirect
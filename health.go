@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+type ReadyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type VersionInfo struct {
+	Module              string `json:"module"`
+	Version             string `json:"version"`
+	GoVersion           string `json:"go_version"`
+	Revision            string `json:"revision,omitempty"`
+	RevisionTime        string `json:"revision_time,omitempty"`
+	Modified            bool   `json:"modified,omitempty"`
+	TLSProfileGenerated string `json:"tls_profile_generated"`
+}
+
+// registerHealth adds the probe endpoints below prefix. They are registered
+// ahead of the file handler chain so probes never reach logRequests. The
+// public listener mounts them under /_/ so they cannot shadow a served
+// path; the admin listener serves no files and keeps them at its root.
+func registerHealth(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"healthz", handleHealthz)
+	mux.HandleFunc(prefix+"readyz", handleReadyz)
+	mux.HandleFunc(prefix+"version", handleVersion)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("json encode", "err", err)
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "health")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "health")
+	checks := []ReadyCheck{
+		runReadyCheck("store", checkStore),
+		runReadyCheck("dir", checkServedDir),
+		runReadyCheck("certificate", checkCertificate),
+	}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, map[string]any{"ready": status == http.StatusOK, "checks": checks})
+}
+
+func runReadyCheck(name string, fn func() error) ReadyCheck {
+	err := fn()
+	if err != nil {
+		return ReadyCheck{Name: name, Error: err.Error()}
+	}
+	return ReadyCheck{Name: name, OK: true}
+}
+
+func checkStore() error {
+	bolton := GetBoltInstance()
+	if bolton == nil || bolton.store == nil {
+		return fmt.Errorf("store not open")
+	}
+	return bolton.store.View(context.Background(), func(tx StoreTx) error {
+		return nil
+	})
+}
+
+func checkServedDir() error {
+	f, err := os.Open(goServDir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadDir(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func checkCertificate() error {
+	cert, err := tls.LoadX509KeyPair(goServTlsCrt, goServTlsKey)
+	if err != nil {
+		return err
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func getVersionInfo() VersionInfo {
+	info := VersionInfo{
+		Module:              "github.com/ruupert/goserv",
+		Version:             "(devel)",
+		GoVersion:           runtime.Version(),
+		TLSProfileGenerated: TLSProfileGenerated,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if bi.Main.Path != "" {
+		info.Module = bi.Main.Path
+	}
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	info.GoVersion = bi.GoVersion
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.RevisionTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "health")
+	writeJSON(w, http.StatusOK, getVersionInfo())
+}
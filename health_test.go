@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	mux := http.NewServeMux()
+	registerHealth(mux, "/_/")
+	var tests = []struct {
+		path string
+		want int
+	}{
+		{"/_/healthz", http.StatusOK},
+		{"/_/version", http.StatusOK},
+		// no certificate is present in the test environment
+		{"/_/readyz", http.StatusServiceUnavailable},
+		// a served file of the same name is not shadowed
+		{"/healthz", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadyzChecks(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	var res struct {
+		Ready  bool         `json:"ready"`
+		Checks []ReadyCheck `json:"checks"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range res.Checks {
+		switch c.Name {
+		case "store", "dir":
+			if !c.OK {
+				t.Errorf("%s check failed: %s", c.Name, c.Error)
+			}
+		case "certificate":
+			if c.OK {
+				t.Errorf("certificate check passed without a certificate")
+			}
+		}
+	}
+}
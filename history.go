@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const historyMaxEntries = 200
+
+// WatchRecord is the value stored per path in the watched bucket.
+type WatchRecord struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+	MaxOffset int64     `json:"max_offset"`
+	Size      int64     `json:"size,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Watched   bool      `json:"watched"`
+	Dir       bool      `json:"dir,omitempty"`
+	ID        string    `json:"id,omitempty"`
+}
+
+// WatchHit is one successful file response merged into a WatchRecord.
+type WatchHit struct {
+	User    string
+	Offset  int64
+	Size    int64
+	Watched bool
+}
+
+type HistoryEntry struct {
+	Path string
+	Href string
+	WatchRecord
+}
+
+type HistoryPageData struct {
+	PageTitle string
+	Entries   []HistoryEntry
+}
+
+// decodeRecord reads a stored value. Values written before records were
+// introduced hold only an RFC3339 timestamp and count as watched.
+func decodeRecord(v []byte) (WatchRecord, bool) {
+	var rec WatchRecord
+	if len(v) == 0 {
+		return rec, false
+	}
+	if v[0] != '{' {
+		t, err := time.Parse(time.RFC3339, string(v))
+		if err != nil {
+			return rec, false
+		}
+		return WatchRecord{FirstSeen: t, LastSeen: t, Count: 1, Watched: true}, true
+	}
+	err := json.Unmarshal(v, &rec)
+	if err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+func encodeRecord(rec WatchRecord) []byte {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		// WatchRecord has no types json cannot encode
+		panic(err)
+	}
+	return v
+}
+
+// merge applies a hit to the record at time now.
+func (rec *WatchRecord) merge(hit WatchHit, now time.Time) {
+	if rec.FirstSeen.IsZero() {
+		rec.FirstSeen = now
+	}
+	rec.LastSeen = now
+	rec.Count++
+	if hit.Offset > rec.MaxOffset {
+		rec.MaxOffset = hit.Offset
+	}
+	if hit.Size > 0 {
+		rec.Size = hit.Size
+	}
+	if hit.User != "" {
+		rec.User = hit.User
+	}
+	rec.Watched = rec.Watched || hit.Watched
+}
+
+// Percent is how far into the file the furthest request reached.
+func (rec WatchRecord) Percent() int {
+	if rec.Size <= 0 {
+		return 0
+	}
+	p := int(rec.MaxOffset * 100 / rec.Size)
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+func (rec WatchRecord) LastSeenString() string {
+	return rec.LastSeen.Local().Format("2006-01-02 15:04")
+}
+
+// getRangeStart returns the first byte offset requested by a Range header.
+func getRangeStart(header string, size int64) int64 {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0
+	}
+	spec, _, _ = strings.Cut(spec, ",")
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n > size {
+			return 0
+		}
+		return size - n
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+func getHistory(limit int) []HistoryEntry {
+	bolton := GetBoltInstance()
+	var entries []HistoryEntry
+	err := bolton.each(func(k string, rec WatchRecord) {
+		entries = append(entries, HistoryEntry{Path: k, Href: getKeyHref(k), WatchRecord: rec})
+	})
+	if err != nil {
+		slog.Error("history", "err", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+func getKeyHref(key string) string {
+	if key == "." {
+		return "/"
+	}
+	return "/" + url.PathEscape(key)
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "history")
+	entries := getHistory(historyMaxEntries)
+	w.Header().Set("Cache-Control", "no-cache")
+	tmpl := template.Must(template.ParseFS(embedded, "assets/templates/history.html"))
+	err := tmpl.Execute(w, HistoryPageData{PageTitle: "history", Entries: entries})
+	if err != nil {
+		slog.Error("template execute", "path", "history", "err", err)
+	}
+}
+
+func handleHistoryAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "api")
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = historyMaxEntries
+	}
+	type item struct {
+		Path string `json:"path"`
+		WatchRecord
+		Percent int `json:"percent"`
+	}
+	var items []item
+	for _, e := range getHistory(limit) {
+		items = append(items, item{Path: e.Path, WatchRecord: e.WatchRecord, Percent: e.Percent()})
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleProgressAPI reports where playback of a file left off, so players
+// can resume with a Range request starting at offset.
+func handleProgressAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "api")
+	key := cleanKey(r.FormValue("path"))
+	rec, ok := GetBoltInstance().getRecord(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"path":       key,
+		"offset":     rec.MaxOffset,
+		"size":       rec.Size,
+		"percent":    rec.Percent(),
+		"watched":    rec.Watched,
+		"last_seen":  rec.LastSeen,
+		"first_seen": rec.FirstSeen,
+		"count":      rec.Count,
+	})
+}
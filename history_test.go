@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeRecordLegacy(t *testing.T) {
+	rec, ok := decodeRecord([]byte("2024-05-01T10:00:00Z"))
+	if !ok || !rec.Watched || rec.LastSeen.Year() != 2024 {
+		t.Fatalf("legacy timestamp not decoded: %+v", rec)
+	}
+	if _, ok := decodeRecord([]byte("garbage")); ok {
+		t.Fatalf("garbage decoded")
+	}
+}
+
+func TestWatchRecordMerge(t *testing.T) {
+	var rec WatchRecord
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec.merge(WatchHit{Offset: 400, Size: 1000, User: "alice"}, t0)
+	rec.merge(WatchHit{Offset: 100, Size: 1000}, t0.Add(time.Hour))
+	if rec.Count != 2 || rec.MaxOffset != 400 || rec.Percent() != 40 || rec.User != "alice" {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if !rec.FirstSeen.Equal(t0) || !rec.LastSeen.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("unexpected timestamps %+v", rec)
+	}
+}
+
+func TestGetRangeStart(t *testing.T) {
+	var tests = []struct {
+		header string
+		want   int64
+	}{
+		{"", 0},
+		{"bytes=500-", 500},
+		{"bytes=500-999", 500},
+		{"bytes=-100", 900},
+		{"bytes=200-299,400-499", 200},
+		{"items=1-2", 0},
+	}
+	for _, tt := range tests {
+		if got := getRangeStart(tt.header, 1000); got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestProgressFromRangeRequests(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "film.mp4"), make([]byte, 1000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir := goServDir
+	goServDir = dir
+	defer func() { goServDir = savedDir }()
+
+	h := logRequests(http.HandlerFunc(handlePath))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = "film.mp4"
+	r.Header.Set("Range", "bytes=300-399")
+	// basic auth names are unverified, so the page must escape them
+	r.SetBasicAuth("<b>mallory</b>", "")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	w := httptest.NewRecorder()
+	handleProgressAPI(w, httptest.NewRequest("GET", "/_/api/progress?path=film.mp4", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("progress returned %d", w.Code)
+	}
+	rec, ok := GetBoltInstance().getRecord("film.mp4")
+	if !ok || rec.MaxOffset != 400 || rec.Percent() != 40 || rec.Watched {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+
+	w = httptest.NewRecorder()
+	handleHistory(w, httptest.NewRequest("GET", "/_/history", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("history returned %d", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "<b>mallory") || !strings.Contains(body, "&lt;b&gt;mallory") {
+		t.Errorf("user not escaped: %s", body)
+	}
+}
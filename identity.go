@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fingerprintChunk is how much of the head and tail of a file is hashed
+// when the platform offers no inode identity.
+const fingerprintChunk = 64 * 1024
+
+// fileIdentity returns a content identity for a file or directory that
+// survives renames and moves within the served tree: device and inode
+// where available, otherwise size plus a hash of the first and last
+// fingerprintChunk bytes. Directories without inode identity have none.
+func fileIdentity(name string, fi os.FileInfo) string {
+	if id, ok := inodeIdentity(fi); ok {
+		return id
+	}
+	if fi.IsDir() {
+		return ""
+	}
+	id, err := fingerprint(name, fi.Size())
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+func fingerprint(name string, size int64) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.CopyN(h, f, fingerprintChunk)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if size > 2*fingerprintChunk {
+		_, err = f.Seek(-fingerprintChunk, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("fp:%d:%s", size, hex.EncodeToString(h.Sum(nil)[:16])), nil
+}
+
+// IdentityLink is what the identities bucket keeps for a file identity:
+// the key it was last seen at and the size and modification time it had
+// there. Inode numbers are reused once a file is deleted, so a rename is
+// only followed while size and modification time still match.
+type IdentityLink struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+func newIdentityLink(key string, fi os.FileInfo) IdentityLink {
+	return IdentityLink{Path: key, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+}
+
+// matches reports whether fi still looks like the entry the link was
+// made for.
+func (l IdentityLink) matches(fi os.FileInfo) bool {
+	return l.ModTime != 0 && l.Size == fi.Size() && l.ModTime == fi.ModTime().UnixNano()
+}
+
+// decodeIdentityLink reads a stored identity. Values written before size
+// and modification time were kept hold only the path; they never match.
+func decodeIdentityLink(v []byte) (IdentityLink, bool) {
+	var l IdentityLink
+	if len(v) == 0 {
+		return l, false
+	}
+	if v[0] != '{' {
+		return IdentityLink{Path: string(v)}, true
+	}
+	err := json.Unmarshal(v, &l)
+	if err != nil {
+		return l, false
+	}
+	return l, true
+}
+
+func encodeIdentityLink(l IdentityLink) []byte {
+	v, err := json.Marshal(l)
+	if err != nil {
+		// IdentityLink has no types json cannot encode
+		panic(err)
+	}
+	return v
+}
+
+// followRename moves the record of a file that was renamed or moved on
+// disk to its new key. The old key must no longer exist, so hard links
+// and copies keep their own records, and the entry at key must still
+// have the size and modification time remembered with the identity.
+func followRename(key string, id string, fi os.FileInfo) bool {
+	if id == "" {
+		return false
+	}
+	bolton := GetBoltInstance()
+	old, ok := bolton.lookupIdentity(id)
+	if !ok || old.Path == key || !old.matches(fi) {
+		return false
+	}
+	if _, err := os.Lstat(filepath.Join(goServDir, old.Path)); err == nil {
+		return false
+	}
+	return bolton.rename(old.Path, key) == nil
+}
+
+// linkIdentities remembers the identities of watched files and of the
+// directories containing them.
+func linkIdentities(keys ...string) {
+	ids := map[string]IdentityLink{}
+	seen := map[string]bool{".": true}
+	for _, key := range keys {
+		for _, k := range append([]string{key}, parentKeys(key)...) {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			name := filepath.Join(goServDir, k)
+			fi, err := os.Stat(name)
+			if err != nil {
+				continue
+			}
+			if id := fileIdentity(name, fi); id != "" {
+				ids[id] = newIdentityLink(k, fi)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	_ = GetBoltInstance().link(ids)
+}
+
+// renamedKey maps key below from to the same place below to.
+func renamedKey(key string, from string, to string) (string, bool) {
+	if key == from {
+		return to, true
+	}
+	if rest, ok := strings.CutPrefix(key, from+"/"); ok {
+		return to + "/" + rest, true
+	}
+	return "", false
+}
+
+// renamedPositionKey is renamedKey for the user NUL path keys of the
+// positions bucket.
+func renamedPositionKey(key string, from string, to string) (string, bool) {
+	user, p, ok := strings.Cut(key, "\x00")
+	if !ok {
+		return "", false
+	}
+	np, ok := renamedKey(p, from, to)
+	if !ok {
+		return "", false
+	}
+	return getPositionKey(user, np), true
+}
+
+// dropIdentities forgets the identities of key and everything below it,
+// so a file that later reuses one of their inodes starts afresh.
+func dropIdentities(tx StoreTx, key string) error {
+	var stale []string
+	err := tx.Iterate(identityBucket, "", func(id string, v []byte) error {
+		l, ok := decodeIdentityLink(v)
+		if !ok {
+			return nil
+		}
+		if key == "." || l.Path == key || strings.HasPrefix(l.Path, key+"/") {
+			stale = append(stale, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range stale {
+		err = tx.Delete(identityBucket, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameKeys moves every record, aggregate, identity and playback position
+// of from, or below it, to to. Records already present at the destination are merged.
+func renameKeys(tx StoreTx, from string, to string) error {
+	if from == "." || to == "." || from == to || strings.HasPrefix(to, from+"/") {
+		return fmt.Errorf("cannot rename %q to %q", from, to)
+	}
+	err := markDirsChanged(tx, time.Now(), from, to)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{watchedBucket, dirStatsBucket} {
+		moved := map[string][]byte{}
+		err := tx.Iterate(name, from, func(k string, v []byte) error {
+			if _, ok := renamedKey(k, from, to); ok {
+				moved[k] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range moved {
+			nk, _ := renamedKey(k, from, to)
+			if name == watchedBucket {
+				rec, _ := decodeRecord(v)
+				if cur, ok := decodeRecord(tx.Get(name, nk)); ok {
+					rec = mergeRecords(cur, rec)
+				}
+				v = encodeRecord(rec)
+			}
+			err = tx.Delete(name, k)
+			if err != nil {
+				return err
+			}
+			err = tx.Put(name, nk, v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	relinked := map[string]IdentityLink{}
+	err = tx.Iterate(identityBucket, "", func(id string, v []byte) error {
+		l, ok := decodeIdentityLink(v)
+		if !ok {
+			return nil
+		}
+		if nk, ok := renamedKey(l.Path, from, to); ok {
+			l.Path = nk
+			relinked[id] = l
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id, l := range relinked {
+		err = tx.Put(identityBucket, id, encodeIdentityLink(l))
+		if err != nil {
+			return err
+		}
+	}
+	positions := map[string][]byte{}
+	err = tx.Iterate(positionBucket, "", func(k string, v []byte) error {
+		if _, ok := renamedPositionKey(k, from, to); ok {
+			positions[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range positions {
+		nk, _ := renamedPositionKey(k, from, to)
+		err = tx.Delete(positionBucket, k)
+		if err != nil {
+			return err
+		}
+		err = tx.Put(positionBucket, nk, v)
+		if err != nil {
+			return err
+		}
+	}
+	return rebuildDirStats(tx)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func inodeIdentity(fi os.FileInfo) (string, bool) {
+	return "", false
+}
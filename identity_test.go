@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupServedDir serves a fresh temporary directory holding the given
+// slash separated files for the duration of the test.
+func setupServedDir(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range files {
+		name := filepath.Join(dir, filepath.FromSlash(f))
+		err := os.MkdirAll(filepath.Dir(name), 0700)
+		if err == nil {
+			err = os.WriteFile(name, []byte("content"), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	savedDir := goServDir
+	goServDir = dir
+	t.Cleanup(func() {
+		goServDir = savedDir
+		forgetIdentities(t)
+	})
+	return dir
+}
+
+// forgetIdentities drops all remembered file identities, so inode numbers
+// reused by the next test's temporary files are not taken for renames.
+func forgetIdentities(t *testing.T) {
+	store := GetBoltInstance().store
+	ids, err := store.List(context.Background(), identityBucket, "")
+	for _, id := range ids {
+		if err == nil {
+			err = store.Delete(context.Background(), identityBucket, id)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func watchFile(t *testing.T, key string) {
+	t.Helper()
+	h := logRequests(http.HandlerFunc(handlePath))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = key
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !isWatched(key) {
+		t.Fatalf("could not watch %s: %d", key, w.Code)
+	}
+}
+
+func TestFollowFileRename(t *testing.T) {
+	dir := setupServedDir(t)
+	err := os.WriteFile(filepath.Join(dir, "ident-old.mkv"), []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchFile(t, "ident-old.mkv")
+	err = os.Rename(filepath.Join(dir, "ident-old.mkv"), filepath.Join(dir, "ident-new.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := populateLinks(dir, ".")
+	if len(links) != 1 || links[0].Tick == "" {
+		t.Fatalf("renamed file lost its tick: %+v", links)
+	}
+	if _, ok := GetBoltInstance().getRecord("ident-old.mkv"); ok {
+		t.Errorf("old key still present")
+	}
+}
+
+func TestFollowDirectoryRename(t *testing.T) {
+	dir := setupServedDir(t)
+	err := os.MkdirAll(filepath.Join(dir, "ident-show", "s01"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		err = os.WriteFile(filepath.Join(dir, "ident-show", "s01", fmt.Sprintf("e%d.mkv", i)), []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	watchFile(t, "ident-show/s01/e1.mkv")
+	err = os.Rename(filepath.Join(dir, "ident-show"), filepath.Join(dir, "ident-series"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	populateLinks(dir, ".")
+	if !isWatched("ident-series/s01/e1.mkv") {
+		t.Fatalf("record did not follow the directory")
+	}
+	if got := getDirProgress(filepath.Join(dir, "ident-series", "s01"), "ident-series/s01"); got != "1/2" {
+		t.Fatalf("progress after rename = %q", got)
+	}
+}
+
+func TestCopyKeepsOriginalRecord(t *testing.T) {
+	dir := setupServedDir(t)
+	err := os.WriteFile(filepath.Join(dir, "ident-a.mkv"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchFile(t, "ident-a.mkv")
+	err = os.Link(filepath.Join(dir, "ident-a.mkv"), filepath.Join(dir, "ident-b.mkv"))
+	if err != nil {
+		t.Skip(err)
+	}
+	populateLinks(dir, ".")
+	if !isWatched("ident-a.mkv") {
+		t.Fatalf("hard link stole the original record")
+	}
+}
+
+func TestGCKeys(t *testing.T) {
+	dir := setupServedDir(t)
+	err := os.WriteFile(filepath.Join(dir, "gc-keep.mkv"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bolton := GetBoltInstance()
+	for _, k := range []string{"gc-keep.mkv", "gc-gone.mkv"} {
+		err = bolton.update(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pruned int
+	err = bolton.store.Update(context.Background(), func(tx StoreTx) error {
+		var err error
+		pruned, err = gcKeys(tx, false)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned == 0 || isWatched("gc-gone.mkv") || !isWatched("gc-keep.mkv") {
+		t.Fatalf("gc pruned %d, gone=%v keep=%v", pruned, isWatched("gc-gone.mkv"), isWatched("gc-keep.mkv"))
+	}
+}
+
+func TestIdentityReuseNotFollowed(t *testing.T) {
+	dir := setupServedDir(t)
+	old := filepath.Join(dir, "ident-old.mkv")
+	err := os.WriteFile(old, []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchFile(t, "ident-old.mkv")
+	fi, err := os.Stat(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fileIdentity(old, fi)
+	// an inode handed to an unrelated file differs in size or mtime from
+	// the one remembered, and so does a value from before they were kept
+	var tests = []struct {
+		name  string
+		write func(name string) error
+	}{
+		{"resized", func(name string) error {
+			return os.WriteFile(name, []byte("other content"), 0600)
+		}},
+		{"touched", func(name string) error {
+			later := time.Now().Add(time.Minute)
+			return os.Chtimes(name, later, later)
+		}},
+		{"legacy", func(name string) error {
+			return GetBoltInstance().store.Put(context.Background(), identityBucket, id, []byte("ident-old.mkv"))
+		}},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, "ident-"+tt.name+".mkv")
+		err = os.Rename(old, name)
+		if err == nil {
+			err = tt.write(name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		populateLinks(dir, ".")
+		if !isWatched("ident-old.mkv") || isWatched("ident-"+tt.name+".mkv") {
+			t.Errorf("%s: record followed a different file", tt.name)
+		}
+		err = os.Rename(name, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		watchFile(t, "ident-old.mkv")
+	}
+}
+
+func TestTrashDropsIdentities(t *testing.T) {
+	dir := setupServedDir(t, "ident-show/e1.mkv")
+	withManage(t, ".")
+	watchFile(t, "ident-show/e1.mkv")
+	var ids []string
+	for _, k := range []string{"ident-show", "ident-show/e1.mkv"} {
+		name := filepath.Join(dir, filepath.FromSlash(k))
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, fileIdentity(name, fi))
+	}
+	_, err := trashEntry("ident-show", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if l, ok := GetBoltInstance().lookupIdentity(id); ok {
+			t.Errorf("identity %s still links %s", id, l.Path)
+		}
+	}
+}
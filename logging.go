@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var accessLogger func(rec *accessRecord)
+
+type accessRecord struct {
+	RemoteAddr string
+	Method     string
+	Path       string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	User       string
+	TLSVersion string
+	Referer    string
+	UserAgent  string
+	Time       time.Time
+}
+
+// statusWriter records the status code and body size written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// rotatingWriter is a file writer that rolls over to numbered backups
+// (name.1, name.2, ...) once the file grows past maxSize bytes.
+type rotatingWriter struct {
+	mu         sync.Mutex
+	name       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingWriter(name string, maxSize int64, maxBackups int) (*rotatingWriter, error) {
+	rw := &rotatingWriter{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	err := rw.open()
+	if err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *rotatingWriter) open() error {
+	f, err := os.OpenFile(rw.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rw.file = f
+	rw.size = fi.Size()
+	return nil
+}
+
+func (rw *rotatingWriter) rotate() error {
+	err := rw.file.Close()
+	if err != nil {
+		return err
+	}
+	if rw.maxBackups > 0 {
+		for i := rw.maxBackups - 1; i > 0; i-- {
+			src := fmt.Sprintf("%s.%d", rw.name, i)
+			if _, err := os.Stat(src); err == nil {
+				err = os.Rename(src, fmt.Sprintf("%s.%d", rw.name, i+1))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = os.Rename(rw.name, rw.name+".1")
+	} else {
+		err = os.Remove(rw.name)
+	}
+	if err != nil {
+		return err
+	}
+	return rw.open()
+}
+
+func (rw *rotatingWriter) Write(b []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.maxSize > 0 && rw.size+int64(len(b)) > rw.maxSize && rw.size > 0 {
+		err := rw.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.file.Write(b)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *rotatingWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.file.Close()
+}
+
+// syncWriter serializes writes from the access log formatters.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(b)
+}
+
+func getLogWriter(dest string) (io.Writer, error) {
+	switch dest {
+	case "", "stdout", "-":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "off":
+		return io.Discard, nil
+	}
+	return newRotatingWriter(dest, goServLogMaxSize*1024*1024, goServLogMaxBackups)
+}
+
+func getLogLevel(level string) slog.Level {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+func newSlogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func initLogging() {
+	w, err := getLogWriter(goServLogFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level := getLogLevel(goServLogLevel)
+	slog.SetDefault(slog.New(newSlogHandler(w, goServLogFormat, level)))
+
+	aw := w
+	if goServAccessLog != goServLogFile {
+		aw, err = getLogWriter(goServAccessLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	accessLogger = newAccessLogger(aw, goServAccessLogFormat)
+}
+
+func newAccessLogger(w io.Writer, format string) func(rec *accessRecord) {
+	switch format {
+	case "common", "combined":
+		sw := &syncWriter{w: w}
+		combined := format == "combined"
+		return func(rec *accessRecord) {
+			_, err := io.WriteString(sw, formatCLF(rec, combined))
+			if err != nil {
+				slog.Error("access log write failed", "err", err)
+			}
+		}
+	}
+	logger := slog.New(newSlogHandler(w, format, slog.LevelInfo))
+	return func(rec *accessRecord) {
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "access",
+			slog.String("remote", rec.RemoteAddr),
+			slog.String("method", rec.Method),
+			slog.String("path", rec.Path),
+			slog.Int("status", rec.Status),
+			slog.Int64("bytes", rec.Bytes),
+			slog.Duration("duration", rec.Duration),
+			slog.String("user", rec.User),
+			slog.String("tls", rec.TLSVersion),
+		)
+	}
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatCLF renders a record in Common Log Format, or Combined Log Format
+// when combined is set.
+func formatCLF(rec *accessRecord, combined bool) string {
+	host, _, err := net.SplitHostPort(rec.RemoteAddr)
+	if err != nil {
+		host = rec.RemoteAddr
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d",
+		clfField(host),
+		clfField(rec.User),
+		rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		rec.Method,
+		rec.Path,
+		rec.Proto,
+		rec.Status,
+		rec.Bytes,
+	)
+	if combined {
+		line += fmt.Sprintf(" %q %q", clfField(rec.Referer), clfField(rec.UserAgent))
+	}
+	return line + "\n"
+}
+
+func getRequestUser(r *http.Request) string {
+	if user := getTokenUser(r); user != "" {
+		return user
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return ""
+}
+
+func getTLSVersion(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return tls.VersionName(r.TLS.Version)
+}
+
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if accessLogger == nil {
+			return
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		accessLogger(&accessRecord{
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       strings.ReplaceAll(r.URL.RequestURI(), "\"", "%22"),
+			Proto:      r.Proto,
+			Status:     sw.status,
+			Bytes:      sw.bytes,
+			Duration:   time.Since(start),
+			User:       getRequestUser(r),
+			TLSVersion: getTLSVersion(r),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Time:       start,
+		})
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFormatCLF(t *testing.T) {
+	rec := &accessRecord{
+		RemoteAddr: "192.0.2.1:51234",
+		Method:     "GET",
+		Path:       "/dir/file.mkv",
+		Proto:      "HTTP/1.1",
+		Status:     206,
+		Bytes:      1024,
+		User:       "alice",
+		Referer:    "https://example.com/",
+		UserAgent:  "mpv",
+		Time:       time.Date(2024, 10, 10, 13, 55, 36, 0, time.UTC),
+	}
+	var tests = []struct {
+		combined bool
+		want     string
+	}{
+		{false, "192.0.2.1 - alice [10/Oct/2024:13:55:36 +0000] \"GET /dir/file.mkv HTTP/1.1\" 206 1024\n"},
+		{true, "192.0.2.1 - alice [10/Oct/2024:13:55:36 +0000] \"GET /dir/file.mkv HTTP/1.1\" 206 1024 \"https://example.com/\" \"mpv\"\n"},
+	}
+	for _, tt := range tests {
+		got := formatCLF(rec, tt.combined)
+		if got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestAccessLogRecordsStatusAndBytes(t *testing.T) {
+	saved := accessLogger
+	defer func() { accessLogger = saved }()
+	var got *accessRecord
+	accessLogger = func(rec *accessRecord) { got = rec }
+
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}))
+	r := httptest.NewRequest("GET", "/pot", nil)
+	r.SetBasicAuth("bob", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got == nil {
+		t.Fatal("no access record")
+	}
+	if got.Status != http.StatusTeapot || got.Bytes != 15 || got.User != "bob" || got.Path != "/pot" {
+		t.Fatalf("unexpected record %+v", got)
+	}
+}
+
+func TestRotatingWriter(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	rw, err := newRotatingWriter(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	for i := 0; i < 4; i++ {
+		_, err = rw.Write([]byte("0123456789"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{name, name + ".1", name + ".2"} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected %s: %s", f, err)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); err == nil {
+		t.Errorf("kept more backups than configured")
+	}
+}
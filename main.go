@@ -3,21 +3,28 @@ package main
 //go:generate go run generators/tls.go
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/fs"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
-	"text/template"
+	"syscall"
 	"time"
 	"unicode/utf8"
 
@@ -26,21 +33,46 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
+// apiPrefix is where the JSON and form endpoints are mounted, under /_/
+// like davPrefix so they cannot shadow a served path.
+const apiPrefix = "/_/api/"
+
 type Link struct {
-	Name string
-	Href string
-	Date int64
-	Tick string
+	Name     string
+	Href     string
+	Date     int64
+	Tick     string
+	Progress string
+	Thumb    string
+	Play     string
 }
 
 type LinkPageData struct {
 	PageTitle string
+	CSRFToken string
+	Grid      bool
+	Upload    bool
+	Mkdir     bool
+	Rename    bool
+	Delete    bool
 	Links     []Link
 }
 
 type boltUpdateType func(uri string) error
 type boltGetType func(uri string) []byte
-type boltDumpType func(uri string) error
+type boltDumpType func(w io.Writer, format string) error
+type boltLoadType func(records []ExportRecord, replace bool) error
+type boltDeleteType func(uri string, recursive bool) error
+type boltBulkUpdateType func(uris []string, dirs []string) error
+type boltProgressType func(uri string, hit WatchHit) error
+type boltProgressBatchType func(writes []progressWrite) error
+type boltGetRecordType func(uri string) (WatchRecord, bool)
+type boltEachType func(fn func(uri string, rec WatchRecord)) error
+type boltRenameType func(from string, to string) error
+type boltLookupIdentityType func(id string) (IdentityLink, bool)
+type boltLinkType func(ids map[string]IdentityLink) error
+type boltGetPositionType func(user string, uri string) (PlaybackPosition, bool)
+type boltPutPositionType func(user string, uri string, pos PlaybackPosition, watched bool) error
 type arrayFlags []string
 
 func (i *arrayFlags) String() string {
@@ -62,30 +94,91 @@ func (i *arrayFlags) Contains(value string) bool {
 }
 
 type Bolton struct {
-	bdb    *bolt.DB
+	store  Store
 	update boltUpdateType
 	get    boltGetType
 	dump   boltDumpType
+	load   boltLoadType
+	delete boltDeleteType
+	bulk   boltBulkUpdateType
+	// progress merges a file response into the record of uri
+	progress boltProgressType
+	// progressBatch applies several progress writes in one transaction
+	progressBatch boltProgressBatchType
+	getRecord     boltGetRecordType
+	each          boltEachType
+	// rename moves the records of from, and everything below it, to to
+	rename         boltRenameType
+	lookupIdentity boltLookupIdentityType
+	link           boltLinkType
+	getPosition    boltGetPositionType
+	// putPosition records where user stopped in uri and, when watched is
+	// set, marks it watched in the same transaction
+	putPosition boltPutPositionType
 }
 
 //go:embed assets/css/style.css
 //go:embed assets/templates/layout.html
+//go:embed assets/templates/history.html
+//go:embed assets/templates/player.html
+//go:embed assets/templates/share.html
+//go:embed assets/templates/shares.html
+//go:embed assets/templates/status.html
 var embedded embed.FS
 
 var singleton *Bolton
 
 var (
-	goServPort            string
-	goServAddr            string
-	goServDir             string
-	goServTlsCrt          string
-	goServTlsKey          string
-	goServBoltDB          string
-	goIgnoreFiles         arrayFlags
-	goServePyroscope      string
-	goServePyroscopeName  string
-	goServePyroscopePort  string
-	goServePyroscopeProto string
+	goServPort                  string
+	goServAddr                  string
+	goServDir                   string
+	goServTlsCrt                string
+	goServTlsKey                string
+	goServBoltDB                string
+	goServStore                 string
+	goServStoreDriver           string
+	goServStoreDSN              string
+	goIgnoreFiles               arrayFlags
+	goServePyroscope            string
+	goServePyroscopeName        string
+	goServePyroscopePort        string
+	goServePyroscopeProto       string
+	goServLogLevel              string
+	goServLogFormat             string
+	goServLogFile               string
+	goServAccessLog             string
+	goServAccessLogFormat       string
+	goServLogMaxSize            int64
+	goServLogMaxBackups         int
+	goServAdminAddr             string
+	goServPprof                 bool
+	goServAdminToken            string
+	goServWatchedBytes          int64
+	goServWatchedPercent        float64
+	goServWriteQueue            int
+	goServThumbDir              string
+	goServThumbWorkers          int
+	goServTokenSecret           string
+	goServPlaylistTokenTTL      time.Duration
+	goServPublicURL             string
+	goServUploadDirs            arrayFlags
+	goServUploadMaxSize         int64
+	goServUploadQuota           int64
+	goServWebDAVWrite           bool
+	goServManage                arrayFlags
+	goServTrashRetention        time.Duration
+	goServAuditAccess           bool
+	goServAuditRetention        time.Duration
+	goServRateLimit             float64
+	goServRateBurst             int
+	goServRateLimitGlobal       float64
+	goServBandwidth             int64
+	goServBandwidthGlobal       int64
+	goServMaxConns              int
+	goServMaxConnsPerIP         int
+	goServMaxDownloads          int
+	goServMaxDownloadsPerClient int
+	goServDownloadQueueTimeout  time.Duration
 )
 
 func init() {
@@ -96,11 +189,50 @@ func init() {
 	flag.StringVar(&goServTlsCrt, "crt", "tls.crt", "crtfile")
 	flag.StringVar(&goServTlsKey, "key", "tls.key", "keyfile")
 	flag.StringVar(&goServBoltDB, "db", "bolt.db", "db file")
+	flag.StringVar(&goServStore, "store", "bolt", "watched state backend: bolt, memory or sqlite")
+	flag.StringVar(&goServStoreDriver, "store-driver", "sqlite3", "database/sql driver name for -store sqlite")
+	flag.StringVar(&goServStoreDSN, "store-dsn", "goserv.sqlite"+sqliteDSNOptions, "data source name for -store sqlite, shared by instances pointing at the same file")
 	flag.Var(&goIgnoreFiles, "ignore", "repeatable, -ignore fname1 -ignore fname2")
-	flag.StringVar(&goServePyroscope, "pyroscope", "", "Pyroscope pplication name")
-	flag.StringVar(&goServePyroscopeName, "pyroscope app name", "", "Pyroscope proto")
-	flag.StringVar(&goServePyroscopePort, "pyroscope port", "4040", "Pyroscope port")
-	flag.StringVar(&goServePyroscopeProto, "pyroscope proto", "http", "Pyroscope proto")
+	flag.StringVar(&goServePyroscope, "pyroscope", "", "Pyroscope server host, continuous profiling is disabled when empty")
+	flag.StringVar(&goServePyroscopeName, "pyroscope-name", "", "Pyroscope application name, defaults to goserv.<host>.<user>")
+	flag.StringVar(&goServePyroscopePort, "pyroscope-port", "4040", "Pyroscope port")
+	flag.StringVar(&goServePyroscopeProto, "pyroscope-proto", "http", "Pyroscope proto")
+	flag.Int64Var(&goServWatchedBytes, "watched-bytes", 0, "mark a file watched after this many bytes were served, 0 disables")
+	flag.Float64Var(&goServWatchedPercent, "watched-percent", 50, "mark a file watched after this percentage of it was served, 0 disables")
+	flag.IntVar(&goServWriteQueue, "write-queue", 1024, "buffer up to this many progress writes and commit them in batches, 0 writes synchronously")
+	flag.StringVar(&goServThumbDir, "thumb-dir", "", "directory caching generated thumbnails, defaults to "+thumbCacheDir+" below -dir")
+	flag.IntVar(&goServThumbWorkers, "thumb-workers", max(1, runtime.NumCPU()/2), "number of thumbnails rendered at the same time")
+	flag.StringVar(&goServTokenSecret, "token-secret", "", "HMAC key for access tokens in playlist URLs, random per process when empty")
+	flag.DurationVar(&goServPlaylistTokenTTL, "playlist-token-ttl", 12*time.Hour, "lifetime of access tokens embedded with ?format=m3u&token=1")
+	flag.StringVar(&goServPublicURL, "public-url", "", "external base URL, such as https://media.example.com, used for share links")
+	flag.Var(&goServUploadDirs, "upload", "repeatable, directory relative to -dir whose subtree accepts uploads through the listing form and tus at "+tusPrefix+"; both require the "+csrfCookieName+" cookie echoed in X-CSRF-Token")
+	flag.Int64Var(&goServUploadMaxSize, "upload-max-size", 4<<30, "largest accepted upload in bytes, 0 is unlimited")
+	flag.Int64Var(&goServUploadQuota, "upload-quota", 0, "total bytes allowed below each -upload directory, 0 is unlimited")
+	flag.BoolVar(&goServWebDAVWrite, "webdav-write", false, "allow PUT, DELETE, MKCOL, COPY, MOVE and LOCK on the WebDAV endpoint under /_/dav/, as far as -upload and -manage permit")
+	flag.Var(&goServManage, "manage", "repeatable, dir=mkdir,rename,delete allows those operations in dir and below from the listing page, a bare dir allows all")
+	flag.DurationVar(&goServTrashRetention, "trash-retention", 30*24*time.Hour, "keep deleted files in the trash this long")
+	flag.BoolVar(&goServAuditAccess, "audit-access", true, "record every file, listing, share and WebDAV access in the audit trail")
+	flag.DurationVar(&goServAuditRetention, "audit-retention", 90*24*time.Hour, "drop audit events older than this, 0 keeps them forever")
+	flag.Float64Var(&goServRateLimit, "rate-limit", 0, "requests per second allowed per client, 0 is unlimited")
+	flag.IntVar(&goServRateBurst, "rate-burst", 20, "requests a client may make at once before -rate-limit applies")
+	flag.Float64Var(&goServRateLimitGlobal, "rate-limit-global", 0, "requests per second allowed for all clients together, 0 is unlimited")
+	flag.Int64Var(&goServBandwidth, "bandwidth", 0, "bytes per second sent to each client, 0 is unlimited")
+	flag.Int64Var(&goServBandwidthGlobal, "bandwidth-global", 0, "bytes per second sent to all clients together, 0 is unlimited")
+	flag.IntVar(&goServMaxConns, "max-conns", 0, "open connections allowed at once, further ones wait to be accepted, 0 is unlimited")
+	flag.IntVar(&goServMaxConnsPerIP, "max-conns-per-ip", 0, "open connections allowed from one address, further ones are closed, 0 is unlimited")
+	flag.IntVar(&goServMaxDownloads, "max-downloads", 0, "file transfers allowed at once, further ones queue, 0 is unlimited")
+	flag.IntVar(&goServMaxDownloadsPerClient, "max-downloads-per-client", 0, "file transfers allowed at once per client, further ones queue, 0 is unlimited")
+	flag.DurationVar(&goServDownloadQueueTimeout, "download-queue-timeout", 30*time.Second, "how long a queued file transfer waits for a slot before 503 Service Unavailable")
+	flag.StringVar(&goServAdminToken, "admin-token", "", "bearer token required by admin endpoints that expose data, such as /backup")
+	flag.BoolVar(&goServPprof, "pprof", false, "serve net/http/pprof under /debug/pprof/ on the admin listener, behind -admin-token")
+	flag.StringVar(&goServLogLevel, "log-level", "info", "log level: debug, info, warn, error")
+	flag.StringVar(&goServLogFormat, "log-format", "text", "log format: text, json")
+	flag.StringVar(&goServLogFile, "log-file", "stdout", "log destination: stdout, stderr or a file path")
+	flag.StringVar(&goServAccessLog, "access-log", "stdout", "access log destination: stdout, stderr, off or a file path")
+	flag.StringVar(&goServAccessLogFormat, "access-log-format", "text", "access log format: text, json, common, combined")
+	flag.Int64Var(&goServLogMaxSize, "log-max-size", 100, "rotate log files after this many megabytes")
+	flag.IntVar(&goServLogMaxBackups, "log-max-backups", 5, "number of rotated log files to keep")
+	flag.StringVar(&goServAdminAddr, "admin-addr", "", "addr:port for the admin listener serving /metrics and /debug/pprof, disabled when empty")
 
 	if !strings.HasSuffix(os.Args[0], ".test") {
 		flag.Parse()
@@ -108,47 +240,40 @@ func init() {
 		goServBoltDB = "testdata/bolt.db"
 	}
 
-	fmt.Println("Initializing")
-	mbdb, err := bolt.Open(goServBoltDB, 0600, nil)
-	if err != nil {
-		log.Fatal(err)
+	if flag.Arg(0) == "db" && goServLogFile == "stdout" {
+		// keep stdout clean for `db export`
+		goServLogFile = "stderr"
 	}
-	err = mbdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte("MyBucket"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
-		return nil
-	})
+	initLogging()
+	slog.Info("initializing", "store", goServStore, "db", goServBoltDB)
+	store, err := openStore(goServStore)
 	if err != nil {
-		fmt.Println(err)
+		log.Fatal(err)
 	}
-	singleton = &Bolton{
-		bdb: mbdb,
+	singleton = NewBolton(store)
+}
+
+// NewBolton builds the watched state operations on top of a Store.
+func NewBolton(store Store) *Bolton {
+	ctx := context.Background()
+	return &Bolton{
+		store: store,
 		update: func(uri string) error {
-			bolton := GetBoltInstance()
-			berr := bolton.bdb.Update(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte("MyBucket"))
-				err := b.Put([]byte(uri), []byte(time.Now().Format(time.RFC3339)))
-				return err
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					return putWatched(tx, uri, false, time.Now())
+				})
 			})
-			if berr != nil {
-				fmt.Println(berr)
-				return berr
-			}
-			return nil
 		},
 		get: func(uri string) []byte {
-			bolton := GetBoltInstance()
 			var res []byte
-			err := bolton.bdb.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte("MyBucket"))
-				v := b.Get([]byte(uri))
-				res = v
-				return nil
+			err := observeBoltTx("view", func() error {
+				var err error
+				res, err = store.Get(ctx, watchedBucket, uri)
+				return err
 			})
 			if err != nil {
-				fmt.Println(err)
+				slog.Error("bolt get", "uri", uri, "err", err)
 			}
 			if len(res) > 0 {
 				return res
@@ -156,21 +281,261 @@ func init() {
 				return []byte("")
 			}
 		},
-		dump: func(uri string) error {
-			bolton := GetBoltInstance()
-			errr := bolton.bdb.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte("MyBucket"))
-				c := b.Cursor()
-				for k, v := c.First(); k != nil; k, v = c.Next() {
-					fmt.Printf("key=%s, value=%s\n", k, v)
+		dump: func(w io.Writer, format string) error {
+			var records []ExportRecord
+			errr := store.Iterate(ctx, watchedBucket, "", func(k string, v []byte) error {
+				if rec, ok := decodeRecord(v); ok {
+					records = append(records, ExportRecord{Path: k, WatchRecord: rec})
 				}
 				return nil
 			})
-			return errr
+			if errr != nil {
+				return errr
+			}
+			switch format {
+			case "json":
+				return exportJSON(w, records)
+			case "csv":
+				return exportCSV(w, records)
+			}
+			return fmt.Errorf("unknown format %q", format)
+		},
+		load: func(records []ExportRecord, replace bool) error {
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					if replace {
+						var keys []string
+						err := tx.Iterate(watchedBucket, "", func(k string, v []byte) error {
+							keys = append(keys, k)
+							return nil
+						})
+						if err != nil {
+							return err
+						}
+						for _, k := range keys {
+							err = tx.Delete(watchedBucket, k)
+							if err != nil {
+								return err
+							}
+						}
+					}
+					for _, r := range records {
+						key := cleanKey(r.Path)
+						rec, ok := decodeRecord(tx.Get(watchedBucket, key))
+						if ok {
+							r.WatchRecord = mergeRecords(rec, r.WatchRecord)
+						}
+						err := tx.Put(watchedBucket, key, encodeRecord(r.WatchRecord))
+						if err != nil {
+							return err
+						}
+					}
+					return rebuildDirStats(tx)
+				})
+			})
+		},
+		delete: func(uri string, recursive bool) error {
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					keys := []string{uri}
+					if recursive {
+						prefix := uri + "/"
+						if uri == "." {
+							prefix = ""
+						}
+						err := tx.Iterate(watchedBucket, prefix, func(k string, v []byte) error {
+							if k != uri {
+								keys = append(keys, k)
+							}
+							return nil
+						})
+						if err != nil {
+							return err
+						}
+					}
+					for _, k := range keys {
+						rec, ok := decodeRecord(tx.Get(watchedBucket, k))
+						if ok && rec.Watched && !rec.Dir {
+							err := adjustDirCounts(tx, k, -1)
+							if err != nil {
+								return err
+							}
+						}
+						err := tx.Delete(watchedBucket, k)
+						if err != nil {
+							return err
+						}
+					}
+					return dropIdentities(tx, uri)
+				})
+			})
+		},
+		bulk: func(uris []string, dirs []string) error {
+			now := time.Now()
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					for _, uri := range uris {
+						err := putWatched(tx, uri, false, now)
+						if err != nil {
+							return err
+						}
+					}
+					for _, uri := range dirs {
+						err := putWatched(tx, uri, true, now)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			})
+		},
+		progress: func(uri string, hit WatchHit) error {
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					return putProgress(tx, uri, hit, time.Now())
+				})
+			})
+		},
+		progressBatch: func(writes []progressWrite) error {
+			now := time.Now()
+			return observeBoltTx("batch", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					for _, w := range writes {
+						err := putProgress(tx, w.uri, w.hit, now)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+			})
+		},
+		getRecord: func(uri string) (WatchRecord, bool) {
+			v, err := store.Get(ctx, watchedBucket, uri)
+			if err != nil {
+				slog.Error("bolt get", "uri", uri, "err", err)
+			}
+			return decodeRecord(v)
+		},
+		each: func(fn func(uri string, rec WatchRecord)) error {
+			return observeBoltTx("view", func() error {
+				return store.Iterate(ctx, watchedBucket, "", func(k string, v []byte) error {
+					if rec, ok := decodeRecord(v); ok {
+						fn(k, rec)
+					}
+					return nil
+				})
+			})
+		},
+		rename: func(from string, to string) error {
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					return renameKeys(tx, from, to)
+				})
+			})
+		},
+		lookupIdentity: func(id string) (IdentityLink, bool) {
+			var res []byte
+			err := observeBoltTx("view", func() error {
+				var err error
+				res, err = store.Get(ctx, identityBucket, id)
+				return err
+			})
+			if err != nil {
+				slog.Error("bolt identity", "id", id, "err", err)
+			}
+			return decodeIdentityLink(res)
+		},
+		link: func(ids map[string]IdentityLink) error {
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					for id, l := range ids {
+						err := tx.Put(identityBucket, id, encodeIdentityLink(l))
+						if err != nil {
+							return err
+						}
+						rec, ok := decodeRecord(tx.Get(watchedBucket, l.Path))
+						if ok && rec.ID != id {
+							rec.ID = id
+							err = tx.Put(watchedBucket, l.Path, encodeRecord(rec))
+							if err != nil {
+								return err
+							}
+						}
+					}
+					return nil
+				})
+			})
+		},
+		getPosition: func(user string, uri string) (PlaybackPosition, bool) {
+			v, err := store.Get(ctx, positionBucket, getPositionKey(user, uri))
+			if err != nil {
+				slog.Error("bolt position", "uri", uri, "err", err)
+			}
+			return decodePosition(v)
+		},
+		putPosition: func(user string, uri string, pos PlaybackPosition, watched bool) error {
+			return observeBoltTx("update", func() error {
+				return store.Update(ctx, func(tx StoreTx) error {
+					err := tx.Put(positionBucket, getPositionKey(user, uri), encodePosition(pos))
+					if err != nil || !watched {
+						return err
+					}
+					rec, _ := decodeRecord(tx.Get(watchedBucket, uri))
+					if rec.Watched {
+						return nil
+					}
+					return putWatched(tx, uri, false, pos.Updated)
+				})
+			})
 		},
 	}
 }
 
+// putWatched sets the watched flag on the record of uri, keeping its history
+// and the directory aggregates in step.
+func putWatched(tx StoreTx, uri string, dir bool, now time.Time) error {
+	rec, _ := decodeRecord(tx.Get(watchedBucket, uri))
+	if !rec.Watched && !dir {
+		err := adjustDirCounts(tx, uri, 1)
+		if err != nil {
+			return err
+		}
+	}
+	if rec.FirstSeen.IsZero() {
+		rec.FirstSeen = now
+	}
+	rec.LastSeen = now
+	rec.Watched = true
+	rec.Dir = dir
+	return tx.Put(watchedBucket, uri, encodeRecord(rec))
+}
+
+// putProgress merges a file response into the record of uri.
+func putProgress(tx StoreTx, uri string, hit WatchHit, now time.Time) error {
+	rec, _ := decodeRecord(tx.Get(watchedBucket, uri))
+	watched := rec.Watched
+	rec.merge(hit, now)
+	if rec.Watched && !watched {
+		err := adjustDirCounts(tx, uri, 1)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Put(watchedBucket, uri, encodeRecord(rec))
+}
+
+// boltDB returns the underlying bolt database for the operations that only
+// the bolt store supports: backups, compaction and size reporting.
+func (b *Bolton) boltDB() (*bolt.DB, error) {
+	bs, ok := b.store.(*boltStore)
+	if !ok {
+		return nil, fmt.Errorf("only supported with -store bolt")
+	}
+	return bs.db, nil
+}
+
 func initPyroscope(addr string, proto string, port string, name string) {
 	runtime.SetMutexProfileFraction(5)
 	runtime.SetBlockProfileRate(5)
@@ -233,6 +598,7 @@ func filterRequests(next http.Handler) http.Handler {
 func serveStatic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "css" {
+			setHandlerName(r, "static")
 			w.Header().Set("Cache-Control", "no-cache")
 			http.ServeFileFS(w, r, embedded, "assets/css/style.css")
 			return
@@ -241,16 +607,31 @@ func serveStatic(next http.Handler) http.Handler {
 	})
 }
 
+// logRequests records playback progress of successful file responses and
+// marks a file watched once enough of it has been served. Listings, static
+// assets and errors are never recorded.
 func logRequests(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		bolton := GetBoltInstance()
+		r, sf := withServedFile(r)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sf.size < 0 || (sw.status != http.StatusOK && sw.status != http.StatusPartialContent) {
+			return
+		}
 		upath := path.Clean(r.URL.Path)
-		//fmt.Println("Upath is: " + upath)
-		err := bolton.update(upath)
+		hit := WatchHit{
+			User:    getRequestUser(r),
+			Offset:  sw.bytes,
+			Size:    sf.size,
+			Watched: watchTracker.record(upath, sw.bytes, sf.size),
+		}
+		if sw.status == http.StatusPartialContent {
+			hit.Offset += getRangeStart(r.Header.Get("Range"), sf.size)
+		}
+		err := recordProgress(upath, hit)
 		if err != nil {
-			fmt.Println(err)
+			slog.Error("bolt update", "path", upath, "err", err)
 		}
-		next.ServeHTTP(w, r)
 	})
 }
 
@@ -258,33 +639,60 @@ func handlePath(w http.ResponseWriter, r *http.Request) {
 	upath := path.Clean(r.URL.Path)
 	name := filepath.Join(goServDir, upath)
 	fh, err := os.Stat(name)
+	if err == nil && isServerDir(upath) {
+		err = fs.ErrNotExist
+	}
 	if err != nil {
-		fmt.Printf("File %s error: %s ", name, err)
+		slog.Warn("stat failed", "file", name, "err", err)
+		http.NotFound(w, r)
 		return
 	}
 	if !fh.IsDir() {
 		// terrible but works
 		if !goIgnoreFiles.Contains(name) {
+			setServedFile(r, fh.Size())
 			serveFile(w, r, name)
 		}
 		return
 	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case "atom", "rss":
+		setHandlerName(r, "feed")
+		serveFeed(w, r, name, upath, format)
+		return
+	case "m3u", "m3u8":
+		setHandlerName(r, "playlist")
+		servePlaylist(w, r, name, upath, format)
+		return
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+	setHandlerName(r, "listing")
 	w.Header().Set("Cache-Control", "no-cache")
 	tmpl := template.Must(template.ParseFS(embedded, "assets/templates/layout.html"))
 	pagedata := LinkPageData{
 		PageTitle: "test",
+		CSRFToken: getCSRFToken(w, r),
+		Grid:      r.URL.Query().Get("view") == "grid",
+		Upload:    canUpload(upath),
+		Mkdir:     canManage(upath, "mkdir"),
+		Rename:    canManage(upath, "rename"),
+		Delete:    canManage(upath, "delete"),
 		Links:     populateLinks(name, upath),
 	}
+	setPlaybackProgress(pagedata.Links, upath, getRequestUser(r))
 	err = tmpl.Execute(w, pagedata)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("template execute", "path", upath, "err", err)
 	}
 }
 
 func populateLinks(name string, upath string) []Link {
 	files, err := os.ReadDir(name)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("read dir", "dir", name, "err", err)
 	}
 	var links []Link
 	for _, file := range files {
@@ -293,11 +701,21 @@ func populateLinks(name string, upath string) []Link {
 			link.Name = file.Name()
 			finfo, err := file.Info()
 			if err != nil {
-				fmt.Println(err)
+				slog.Warn("file info", "file", file.Name(), "err", err)
+				continue
 			}
 			link.Date = finfo.ModTime().Unix()
 			link.Href = getHref(file, upath)
+			if len(GetBoltInstance().get(getKey(upath, file.Name()))) == 0 {
+				followRename(getKey(upath, file.Name()), fileIdentity(filepath.Join(name, file.Name()), finfo), finfo)
+			}
 			link.Tick = getTick(upath, file.Name())
+			if file.IsDir() {
+				link.Progress = getDirProgress(filepath.Join(name, file.Name()), getKey(upath, file.Name()))
+			} else {
+				link.Thumb = getThumbHref(getKey(upath, file.Name()))
+				link.Play = getPlayHref(getKey(upath, file.Name()))
+			}
 			links = append(links, link)
 		}
 	}
@@ -323,17 +741,19 @@ func getHref(file fs.DirEntry, upath string) string {
 	return res
 }
 
+// getKey returns the bolt key of an entry in the directory upath.
+func getKey(upath string, name string) string {
+	if upath == "." {
+		return name
+	}
+	return upath + "/" + name
+}
+
 func getTick(upath string, name string) string {
 	var res string
 	bolton := GetBoltInstance()
-	var path []byte
-	if upath == "." {
-		path = bolton.get(name)
-	} else {
-		path = bolton.get(upath + "/" + name)
-	}
-	_, terr := time.Parse(time.RFC3339, string(path))
-	if terr != nil {
+	rec, ok := decodeRecord(bolton.get(getKey(upath, name)))
+	if !ok || !rec.Watched {
 		res = ""
 	} else {
 		src := "\u2713\u2715"
@@ -344,18 +764,99 @@ func getTick(upath string, name string) string {
 }
 
 func serveFile(w http.ResponseWriter, r *http.Request, name string) {
-	fmt.Println("Serving: " + name)
-	http.ServeFile(w, r, name)
+	slog.Debug("serving file", "file", name)
+	setHandlerName(r, "file")
+	sendFile(w, r, name)
 }
 
 func main() {
-	if goServAddr != "" {
+	if flag.NArg() > 0 && flag.Arg(0) == "db" {
+		err := runDBCommand(flag.Args()[1:])
+		GetBoltInstance().store.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if goServePyroscope != "" {
 		initPyroscope(goServePyroscope, goServePyroscopeProto, goServePyroscopePort, getPyroscopeAppName())
 	}
+	if goServPprof {
+		if goServAdminAddr == "" {
+			log.Fatal("-pprof requires -admin-addr")
+		}
+		registerPprof(adminMux)
+	}
+	if goServAdminAddr != "" {
+		startAdmin(goServAdminAddr)
+	}
 	mux := http.NewServeMux()
 	finalHandler := http.HandlerFunc(handlePath)
-	mux.Handle("/", http.StripPrefix("/", filterRequests(serveStatic(logRequests(finalHandler)))))
+	registerHealth(mux, "/_/")
+	mux.Handle(apiPrefix+"watched", http.HandlerFunc(handleWatchedAPI))
+	mux.Handle(apiPrefix+"history", http.HandlerFunc(handleHistoryAPI))
+	mux.Handle(apiPrefix+"progress", http.HandlerFunc(handleProgressAPI))
+	mux.Handle("/_/history", http.HandlerFunc(handleHistory))
+	mux.Handle("/_/thumb", http.HandlerFunc(handleThumb))
+	mux.Handle("/_/play", http.HandlerFunc(handlePlayer))
+	mux.Handle(apiPrefix+"position", http.HandlerFunc(handlePositionAPI))
+	mux.Handle("/_/subs", http.HandlerFunc(handleSubtitles))
+	mux.Handle(apiPrefix+"subtitles", http.HandlerFunc(handleSubtitlesAPI))
+	mux.Handle("/_/s/", auditRequests(getShareKey, http.HandlerFunc(handleShare)))
+	mux.Handle(apiPrefix+"upload", http.HandlerFunc(handleUploadAPI))
+	mux.Handle(tusPrefix, http.HandlerFunc(handleTus))
+	mux.Handle(apiPrefix+"files", http.HandlerFunc(handleFilesAPI))
+	mux.Handle(davPrefix, http.StripPrefix(davPrefix, checkAccessToken(auditRequests(getURLKey, http.HandlerFunc(handleWebDAV)))))
+	mux.Handle("/", http.StripPrefix("/", filterRequests(serveStatic(checkAccessToken(auditRequests(getURLKey, logRequests(finalHandler)))))))
 	srv := getTLSSrv(goServAddr, goServPort, TLSConfig, mux)
-	fmt.Printf("Listening on %s\n", goServPort)
-	log.Fatal(srv.ListenAndServeTLS(goServTlsCrt, goServTlsKey))
+	srv.Handler = accessLog(instrumentRequests(limitRequests(mux)))
+	srv.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+	startWriteQueue(goServWriteQueue)
+	startAuditQueue(goServWriteQueue)
+	startAuditRetention(goServAuditRetention)
+	startRateLimits()
+	startConnLimits()
+	startUploads()
+	startThumbnails()
+	startWatchTracker()
+	err := startFileManagement()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if goServWebDAVWrite {
+		hideStagingDir()
+	}
+	idle := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		slog.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			slog.Warn("shutdown", "err", err)
+		}
+		close(idle)
+	}()
+	slog.Info("listening", "addr", goServAddr, "port", goServPort)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = srv.ServeTLS(connLimiter.limitListener(ln), goServTlsCrt, goServTlsKey)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-idle
+	// flush pending progress before the store goes away
+	if writeQueue != nil {
+		writeQueue.Close()
+	}
+	if auditQueue != nil {
+		auditQueue.Close()
+	}
+	GetBoltInstance().store.Close()
 }
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -21,6 +24,7 @@ func teardown() {
 }
 
 func TestMain(m *testing.M) {
+	startWatchTracker()
 	code := m.Run()
 	teardown()
 	os.Exit(code)
@@ -63,3 +67,17 @@ func TestPopulateLinkNames(t *testing.T) {
 		})
 	}
 }
+
+func TestListingEscapesNames(t *testing.T) {
+	setupServedDir(t, `<img src=x onerror=alert(1)>.txt`, `javascript:alert(1)`)
+	withManage(t, ".")
+	w := httptest.NewRecorder()
+	http.StripPrefix("/", http.HandlerFunc(handlePath)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(body, "<img src=x") || !strings.Contains(body, "&lt;img src=x onerror=alert(1)&gt;.txt") {
+		t.Errorf("name not escaped: %d %s", w.Code, body)
+	}
+	if strings.Contains(body, `href="javascript:`) {
+		t.Errorf("script URL in href: %s", body)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A minimal Prometheus text exposition (format 0.0.4) implementation, kept
+// in-tree to avoid pulling client_golang and its dependency graph.
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (mr *metricsRegistry) register(c collector) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.collectors = append(mr.collectors, c)
+}
+
+func (mr *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for _, c := range mr.collectors {
+		c.collect(w)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", n, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]*counterSeries{}}
+}
+
+func (cv *counterVec) add(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	s, ok := cv.values[key]
+	if !ok {
+		s = &counterSeries{labels: labels}
+		cv.values[key] = s
+	}
+	s.value += v
+}
+
+func (cv *counterVec) inc(labels ...string) {
+	cv.add(1, labels...)
+}
+
+func (cv *counterVec) collect(w io.Writer) {
+	writeHeader(w, cv.name, cv.help, "counter")
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	for _, key := range sortedKeys(cv.values) {
+		s := cv.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, formatLabels(cv.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramSeries{}}
+}
+
+func (hv *histogramVec) observe(v float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	s, ok := hv.values[key]
+	if !ok {
+		s = &histogramSeries{labels: labels, counts: make([]uint64, len(hv.buckets))}
+		hv.values[key] = s
+	}
+	for i, b := range hv.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (hv *histogramVec) collect(w io.Writer) {
+	writeHeader(w, hv.name, hv.help, "histogram")
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	for _, key := range sortedKeys(hv.values) {
+		s := hv.values[key]
+		for i, b := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, s.labels, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, formatLabels(hv.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, formatLabels(hv.labels, s.labels), s.count)
+	}
+}
+
+type gauge struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+func newGauge(name string, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) add(v int64) {
+	g.value.Add(v)
+}
+
+func (g *gauge) collect(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.value.Load())
+}
+
+// gaugeFunc is a gauge whose value is computed at scrape time.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (gf *gaugeFunc) collect(w io.Writer) {
+	writeHeader(w, gf.name, gf.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gf.name, formatFloat(gf.fn()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	metrics = &metricsRegistry{}
+
+	httpRequestsTotal = newCounterVec("goserv_http_requests_total",
+		"Number of HTTP requests by handler, method and status code.", "handler", "method", "code")
+	httpRequestDuration = newHistogramVec("goserv_http_request_duration_seconds",
+		"HTTP request latency by handler and status code.", latencyBuckets, "handler", "code")
+	httpResponseBytes = newCounterVec("goserv_http_response_bytes_total",
+		"Bytes written in HTTP response bodies by handler.", "handler")
+	activeDownloads = newGauge("goserv_active_downloads",
+		"Number of file transfers currently in progress.")
+	boltTxDuration = newHistogramVec("goserv_bolt_tx_duration_seconds",
+		"Duration of bolt transactions by operation.", latencyBuckets, "op")
+	writeQueueBatch = newHistogramVec("goserv_write_queue_batch_size",
+		"Number of queued writes, progress or audit events, committed per transaction.", []float64{1, 2, 5, 10, 25, 50, 100, 250, 1000})
+	writeQueueOverflow = newCounterVec("goserv_write_queue_overflow_total",
+		"Queued writes applied synchronously because their write queue was full.")
+	auditLost = newCounterVec("goserv_audit_events_lost_total",
+		"Audit events dropped after their write failed on every retry.")
+	rateLimited = newCounterVec("goserv_rate_limited_total",
+		"Requests rejected with 429 by the rate limiter.")
+	rejectedConns = newCounterVec("goserv_rejected_connections_total",
+		"Connections closed on accept because their address was at -max-conns-per-ip.")
+)
+
+func init() {
+	metrics.register(httpRequestsTotal)
+	metrics.register(httpRequestDuration)
+	metrics.register(httpResponseBytes)
+	metrics.register(activeDownloads)
+	metrics.register(boltTxDuration)
+	metrics.register(writeQueueBatch)
+	metrics.register(writeQueueOverflow)
+	metrics.register(auditLost)
+	metrics.register(rateLimited)
+	metrics.register(rejectedConns)
+	metrics.register(&gaugeFunc{
+		name: "goserv_open_connections",
+		help: "Number of connections currently open on the file listener.",
+		fn: func() float64 {
+			if connLimiter == nil {
+				return 0
+			}
+			return float64(connLimiter.open())
+		},
+	})
+	metrics.register(&gaugeFunc{
+		name: "goserv_queued_downloads",
+		help: "Number of file transfers waiting for a slot.",
+		fn: func() float64 {
+			if transferLimiter == nil {
+				return 0
+			}
+			_, n := transferLimiter.counts()
+			return float64(n)
+		},
+	})
+	metrics.register(&gaugeFunc{
+		name: "goserv_write_queue_depth",
+		help: "Number of progress writes waiting in the write queue.",
+		fn: func() float64 {
+			if writeQueue == nil {
+				return 0
+			}
+			return float64(writeQueue.depth())
+		},
+	})
+	metrics.register(&gaugeFunc{
+		name: "goserv_bolt_db_size_bytes",
+		help: "Size of the bolt database.",
+		fn:   getBoltSize,
+	})
+	metrics.register(&gaugeFunc{
+		name: "goserv_goroutines",
+		help: "Number of goroutines that currently exist.",
+		fn:   func() float64 { return float64(runtime.NumGoroutine()) },
+	})
+}
+
+func getBoltSize() float64 {
+	bolton := GetBoltInstance()
+	if bolton == nil {
+		return 0
+	}
+	db, err := bolton.boltDB()
+	if err != nil {
+		return 0
+	}
+	var size int64
+	_ = db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return float64(size)
+}
+
+// observeBoltTx times a bolt transaction for goserv_bolt_tx_duration_seconds.
+func observeBoltTx(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	boltTxDuration.observe(time.Since(start).Seconds(), op)
+	return err
+}
+
+type handlerNameKey struct{}
+
+// getHandlerName returns the label set by setHandlerName, or "" outside
+// instrumented requests.
+func getHandlerName(r *http.Request) string {
+	if p, ok := r.Context().Value(handlerNameKey{}).(*string); ok {
+		return *p
+	}
+	return ""
+}
+
+// setHandlerName labels the current request for the request metrics. The
+// label defaults to "other" when no handler claims the request.
+func setHandlerName(r *http.Request, name string) {
+	if p, ok := r.Context().Value(handlerNameKey{}).(*string); ok {
+		*p = name
+	}
+}
+
+// knownMethods are the request methods goserv answers. Anything else is
+// counted as "other", so clients cannot add label values at will.
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+	"PROPPATCH":        true,
+	"MKCOL":            true,
+	"COPY":             true,
+	"MOVE":             true,
+	"LOCK":             true,
+	"UNLOCK":           true,
+}
+
+func getMethodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler := "other"
+		r = r.WithContext(context.WithValue(r.Context(), handlerNameKey{}, &handler))
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		code := strconv.Itoa(sw.status)
+		httpRequestsTotal.inc(handler, getMethodLabel(r.Method), code)
+		httpRequestDuration.observe(time.Since(start).Seconds(), handler, code)
+		httpResponseBytes.add(float64(sw.bytes), handler)
+	})
+}
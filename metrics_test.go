@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*",?)*\})? (\S+)$`)
+
+type sample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+// parseExposition checks the text format line by line and returns the
+// samples along with the declared type of every metric family.
+func parseExposition(t *testing.T, r io.Reader) ([]sample, map[string]string) {
+	t.Helper()
+	types := map[string]string{}
+	var samples []sample
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			f := strings.Fields(line)
+			if len(f) != 4 {
+				t.Fatalf("bad TYPE line %q", line)
+			}
+			types[f[2]] = f[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("bad sample line %q", line)
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("bad value in %q: %s", line, err)
+		}
+		family := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(m[1], "_bucket"), "_sum"), "_count")
+		if _, ok := types[m[1]]; !ok {
+			if _, ok := types[family]; !ok {
+				t.Fatalf("sample %q has no TYPE", m[1])
+			}
+		}
+		samples = append(samples, sample{name: m[1], labels: m[2], value: v})
+	}
+	return samples, types
+}
+
+func findSample(samples []sample, name string, labels ...string) (float64, bool) {
+	for _, s := range samples {
+		if s.name != name {
+			continue
+		}
+		match := true
+		for _, l := range labels {
+			if !strings.Contains(s.labels, l) {
+				match = false
+			}
+		}
+		if match {
+			return s.value, true
+		}
+	}
+	return 0, false
+}
+
+func TestMetricsExposition(t *testing.T) {
+	h := instrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setHandlerName(r, "listing")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	_ = observeBoltTx("view", func() error { return nil })
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	samples, types := parseExposition(t, w.Body)
+
+	for name, typ := range map[string]string{
+		"goserv_http_requests_total":           "counter",
+		"goserv_http_request_duration_seconds": "histogram",
+		"goserv_http_response_bytes_total":     "counter",
+		"goserv_active_downloads":              "gauge",
+		"goserv_bolt_tx_duration_seconds":      "histogram",
+		"goserv_bolt_db_size_bytes":            "gauge",
+	} {
+		if types[name] != typ {
+			t.Errorf("%s: want type %s, got %q", name, typ, types[name])
+		}
+	}
+	if v, ok := findSample(samples, "goserv_http_requests_total", `handler="listing"`, `code="200"`); !ok || v < 3 {
+		t.Errorf("requests_total for listing = %v, %v", v, ok)
+	}
+	if v, ok := findSample(samples, "goserv_http_response_bytes_total", `handler="listing"`); !ok || v < 15 {
+		t.Errorf("response_bytes_total for listing = %v, %v", v, ok)
+	}
+	count, _ := findSample(samples, "goserv_http_request_duration_seconds_count", `handler="listing"`)
+	inf, _ := findSample(samples, "goserv_http_request_duration_seconds_bucket", `handler="listing"`, `le="+Inf"`)
+	if count < 3 || count != inf {
+		t.Errorf("histogram count %v does not match +Inf bucket %v", count, inf)
+	}
+	if _, ok := findSample(samples, "goserv_bolt_tx_duration_seconds_count", `op="view"`); !ok {
+		t.Errorf("missing bolt view timings")
+	}
+	if v, _ := findSample(samples, "goserv_bolt_db_size_bytes"); v <= 0 {
+		t.Errorf("bolt size = %v", v)
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	got := formatLabels([]string{"path"}, []string{"a\"b\\c\nd"})
+	want := `{path="a\"b\\c\nd"}`
+	if got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestGetMethodLabel(t *testing.T) {
+	var tests = []struct {
+		method string
+		want   string
+	}{
+		{"GET", "GET"},
+		{"PROPFIND", "PROPFIND"},
+		{"UNLOCK", "UNLOCK"},
+		{"get", "other"},
+		{"X-RANDOM-1234", "other"},
+	}
+	for _, tt := range tests {
+		if got := getMethodLabel(tt.method); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.method, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// positionWatchedPercent marks a file watched once playback passes this
+// point when -watched-percent is disabled.
+const positionWatchedPercent = 90
+
+var playerVideoTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".ogv":  "video/ogg",
+}
+
+var playerAudioTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+}
+
+// getMediaKind returns "video" or "audio" for files the player page can
+// play, and "" for everything else.
+func getMediaKind(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if _, ok := playerVideoTypes[ext]; ok {
+		return "video"
+	}
+	if _, ok := playerAudioTypes[ext]; ok {
+		return "audio"
+	}
+	return ""
+}
+
+// getPlayHref returns the player page URL of the entry key, or "" when it
+// is not a media file.
+func getPlayHref(key string) string {
+	if getMediaKind(key) == "" {
+		return ""
+	}
+	return "/_/play?path=" + url.QueryEscape(key)
+}
+
+// PlaybackPosition is where a user stopped in a media file, kept per user in
+// the positions bucket.
+type PlaybackPosition struct {
+	Position float64   `json:"position"`
+	Duration float64   `json:"duration"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Percent is the share of the file played, 0 when the duration is unknown.
+func (p PlaybackPosition) Percent() int {
+	if p.Duration <= 0 {
+		return 0
+	}
+	return int(math.Min(100, p.Position*100/p.Duration))
+}
+
+// getPositionKey joins user and path; NUL cannot occur in either.
+func getPositionKey(user string, key string) string {
+	return user + "\x00" + key
+}
+
+func decodePosition(v []byte) (PlaybackPosition, bool) {
+	var pos PlaybackPosition
+	if len(v) == 0 {
+		return pos, false
+	}
+	err := json.Unmarshal(v, &pos)
+	return pos, err == nil
+}
+
+func encodePosition(pos PlaybackPosition) []byte {
+	v, err := json.Marshal(pos)
+	if err != nil {
+		// PlaybackPosition has no types json cannot encode
+		panic(err)
+	}
+	return v
+}
+
+// positionWatched reports whether playback reached the watched threshold.
+func positionWatched(pos PlaybackPosition) bool {
+	percent := goServWatchedPercent
+	if percent <= 0 {
+		percent = positionWatchedPercent
+	}
+	return pos.Duration > 0 && pos.Position*100/pos.Duration >= percent
+}
+
+// setPlaybackProgress shows how far user got into the unwatched media files
+// of a listing.
+func setPlaybackProgress(links []Link, upath string, user string) {
+	bolton := GetBoltInstance()
+	for i := range links {
+		l := &links[i]
+		if l.Play == "" || l.Tick != "" {
+			continue
+		}
+		pos, ok := bolton.getPosition(user, getKey(upath, l.Name))
+		if ok && pos.Percent() > 0 {
+			l.Progress = fmt.Sprintf("%d%%", pos.Percent())
+		}
+	}
+}
+
+type PlayerPageData struct {
+	PageTitle string
+	CSRFToken string
+	Kind      string
+	Type      string
+	Path      string
+	Src       string
+	Back      string
+	Tracks    []SubtitleTrack
+}
+
+// handlePlayer serves the HTML5 player page for ?path=.
+func handlePlayer(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "player")
+	key := cleanKey(r.FormValue("path"))
+	kind := getMediaKind(key)
+	if kind == "" || isServerDir(key) || goIgnoreFiles.Contains(filepath.Base(key)) {
+		http.NotFound(w, r)
+		return
+	}
+	fh, err := os.Stat(filepath.Join(goServDir, filepath.FromSlash(key)))
+	if err != nil || fh.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	ext := strings.ToLower(path.Ext(key))
+	mime := playerVideoTypes[ext]
+	if kind == "audio" {
+		mime = playerAudioTypes[ext]
+	}
+	back := "/" + url.PathEscape(path.Dir(key))
+	if path.Dir(key) == "." {
+		back = "/"
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	tmpl := template.Must(template.ParseFS(embedded, "assets/templates/player.html"))
+	err = tmpl.Execute(w, PlayerPageData{
+		PageTitle: path.Base(key),
+		CSRFToken: getCSRFToken(w, r),
+		Kind:      kind,
+		Type:      mime,
+		Path:      url.QueryEscape(key),
+		Src:       "/" + url.PathEscape(key),
+		Back:      back,
+		Tracks:    findSubtitles(key),
+	})
+	if err != nil {
+		slog.Error("template execute", "path", key, "err", err)
+	}
+}
+
+// handlePositionAPI reads (GET) or records (POST position=&duration=) the
+// playback position of ?path= for the requesting user.
+func handlePositionAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "api")
+	key := cleanKey(r.FormValue("path"))
+	user := getRequestUser(r)
+	bolton := GetBoltInstance()
+	switch r.Method {
+	case http.MethodGet:
+		pos, ok := bolton.getPosition(user, key)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"path":     key,
+			"position": pos.Position,
+			"duration": pos.Duration,
+			"percent":  pos.Percent(),
+			"updated":  pos.Updated,
+		})
+	case http.MethodPost:
+		if !checkCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		position, err := strconv.ParseFloat(r.FormValue("position"), 64)
+		if err != nil || position < 0 || math.IsInf(position, 0) || math.IsNaN(position) {
+			http.Error(w, "Invalid position", http.StatusBadRequest)
+			return
+		}
+		duration, err := strconv.ParseFloat(r.FormValue("duration"), 64)
+		if err != nil || duration < 0 || math.IsInf(duration, 0) || math.IsNaN(duration) {
+			duration = 0
+		}
+		// positions belong to files the player could open
+		if isHiddenKey(key) {
+			http.NotFound(w, r)
+			return
+		}
+		if fi, err := os.Stat(filepath.Join(goServDir, filepath.FromSlash(key))); err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		pos := PlaybackPosition{Position: position, Duration: duration, Updated: time.Now()}
+		watched := positionWatched(pos)
+		err = bolton.putPosition(user, key, pos, watched)
+		if err != nil {
+			slog.Error("position api", "path", key, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if watched {
+			linkIdentities(key)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"path": key, "percent": pos.Percent(), "watched": watched})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+	}
+}
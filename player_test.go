@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGetMediaKind(t *testing.T) {
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"show/e01.MKV", "video"},
+		{"clip.webm", "video"},
+		{"album/01.flac", "audio"},
+		{"notes.txt", ""},
+		{"mp4", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getMediaKind(tt.name); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlayerPage(t *testing.T) {
+	setupServedDir(t, "movies/film.mp4", "movies/notes.txt", "movies/<b>x</b>.mp3", trashDir+"/1/film.mp4")
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlePlayer(w, httptest.NewRequest("GET", "/_/play?path="+url.QueryEscape(p), nil))
+		return w
+	}
+	w := get("movies/film.mp4")
+	if w.Code != http.StatusOK {
+		t.Fatalf("player returned %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"<video", `src="/movies%2Ffilm.mp4"`, `type="video/mp4"`, `href="/movies"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("player page lacks %s", want)
+		}
+	}
+	// file names are attacker controlled and must come out escaped
+	w = get("movies/<b>x</b>.mp3")
+	if body := w.Body.String(); !strings.Contains(body, "<audio") || strings.Contains(body, "<b>x") {
+		t.Errorf("audio page: %s", body)
+	}
+	for _, p := range []string{"movies/notes.txt", "movies/missing.mp4", "movies", trashDir + "/1/film.mp4"} {
+		if w := get(p); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", p, w.Code)
+		}
+	}
+}
+
+func TestPositionAPI(t *testing.T) {
+	setupServedDir(t, "pos/a.mkv")
+	call := func(method string, user string, form url.Values) *httptest.ResponseRecorder {
+		target := "/_/api/position?path=" + url.QueryEscape("pos/a.mkv")
+		var r *http.Request
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, target, nil)
+		}
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+		r.Header.Set("X-CSRF-Token", "t0ken")
+		if user != "" {
+			r.SetBasicAuth(user, "x")
+		}
+		w := httptest.NewRecorder()
+		handlePositionAPI(w, r)
+		return w
+	}
+
+	if w := call("GET", "alice", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("GET before any position: %d", w.Code)
+	}
+	if w := call("POST", "alice", url.Values{"position": {"nope"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad position: %d", w.Code)
+	}
+	if w := call("POST", "alice", url.Values{"position": {"340"}, "duration": {"1000"}}); w.Code != http.StatusOK {
+		t.Fatalf("POST: %d", w.Code)
+	}
+	w := call("GET", "alice", nil)
+	var got struct {
+		Position float64 `json:"position"`
+		Percent  int     `json:"percent"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Position != 340 || got.Percent != 34 {
+		t.Errorf("got %+v", got)
+	}
+	if w := call("GET", "bob", nil); w.Code != http.StatusNotFound {
+		t.Errorf("position leaked to another user: %d", w.Code)
+	}
+	if isWatched("pos/a.mkv") {
+		t.Errorf("marked watched at 34%%")
+	}
+
+	links := []Link{{Name: "a.mkv", Play: getPlayHref("pos/a.mkv")}}
+	setPlaybackProgress(links, "pos", "alice")
+	if links[0].Progress != "34%" {
+		t.Errorf("listing progress = %q, want 34%%", links[0].Progress)
+	}
+
+	call("POST", "alice", url.Values{"position": {"950"}, "duration": {"1000"}})
+	if !isWatched("pos/a.mkv") {
+		t.Errorf("not marked watched at 95%%")
+	}
+
+	err = GetBoltInstance().rename("pos", "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos, ok := GetBoltInstance().getPosition("alice", "moved/a.mkv"); !ok || pos.Position != 950 {
+		t.Errorf("position not renamed: %+v", pos)
+	}
+}
+
+func TestPositionAPIRejectsMissingCSRF(t *testing.T) {
+	r := httptest.NewRequest("POST", "/_/api/position?path=x.mkv&position=1", nil)
+	w := httptest.NewRecorder()
+	handlePositionAPI(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403", w.Code)
+	}
+}
+
+func TestPositionAPIRejectsHiddenPaths(t *testing.T) {
+	setupServedDir(t, "pos/a.mkv", trashDir+"/1/a.mkv", uploadStagingDir+"/a.mkv", ".hidden/a.mkv")
+	saved := goIgnoreFiles
+	goIgnoreFiles = append(arrayFlags{}, ".hidden")
+	defer func() { goIgnoreFiles = saved }()
+	var tests = []struct {
+		key  string
+		want int
+	}{
+		{"pos/a.mkv", http.StatusOK},
+		{"pos", http.StatusNotFound},
+		{trashDir + "/1/a.mkv", http.StatusNotFound},
+		{uploadStagingDir + "/a.mkv", http.StatusNotFound},
+		{".hidden/a.mkv", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		form := url.Values{"path": {tt.key}, "position": {"10"}, "duration": {"100"}}
+		r := httptest.NewRequest("POST", "/_/api/position", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+		r.Header.Set("X-CSRF-Token", "t0ken")
+		w := httptest.NewRecorder()
+		handlePositionAPI(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.key, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// playlistMaxEntries bounds recursive playlists of huge trees.
+const playlistMaxEntries = 10000
+
+type playlistEntry struct {
+	Title string
+	Href  string
+}
+
+// collectPlaylist appends the playable files of the directory name, known
+// as upath, in the order populateLinks lists them: newest first at the
+// root, by name below it. Subdirectories are descended into in the same
+// order when recursive is set.
+func collectPlaylist(entries []playlistEntry, name string, upath string, recursive bool) []playlistEntry {
+	files, err := os.ReadDir(name)
+	if err != nil {
+		slog.Warn("read dir", "dir", name, "err", err)
+		return entries
+	}
+	type item struct {
+		file os.DirEntry
+		date int64
+	}
+	var items []item
+	for _, file := range files {
+		if goIgnoreFiles.Contains(file.Name()) {
+			continue
+		}
+		if !file.IsDir() && getMediaKind(file.Name()) == "" {
+			continue
+		}
+		if file.IsDir() && !recursive {
+			continue
+		}
+		finfo, err := file.Info()
+		if err != nil {
+			continue
+		}
+		items = append(items, item{file: file, date: finfo.ModTime().Unix()})
+	}
+	if upath == "." {
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].date > items[j].date
+		})
+	} else {
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].file.Name() < items[j].file.Name()
+		})
+	}
+	for _, it := range items {
+		if len(entries) >= playlistMaxEntries {
+			break
+		}
+		if it.file.IsDir() {
+			entries = collectPlaylist(entries, filepath.Join(name, it.file.Name()), getKey(upath, it.file.Name()), recursive)
+			continue
+		}
+		title := strings.TrimSuffix(it.file.Name(), path.Ext(it.file.Name()))
+		if upath != "." {
+			title = upath + "/" + title
+		}
+		entries = append(entries, playlistEntry{Title: title, Href: getHref(it.file, upath)})
+	}
+	return entries
+}
+
+// servePlaylist writes an extended M3U playlist of the media files in the
+// directory. ?recursive=1 includes subdirectories and ?token=1 appends a
+// short-lived access token to every URL for players that cannot
+// authenticate.
+func servePlaylist(w http.ResponseWriter, r *http.Request, name string, upath string, format string) {
+	q := r.URL.Query()
+	recursive := q.Get("recursive") == "1" || q.Get("recursive") == "true"
+	suffix := ""
+	if q.Get("token") == "1" || q.Get("token") == "true" {
+		// only a verified user may be carried on; a Basic auth name would
+		// come back signed and trusted
+		token := mintAccessToken(getTokenUser(r), upath, goServPlaylistTokenTTL)
+		suffix = "?" + accessTokenParam + "=" + url.QueryEscape(token)
+	}
+	entries := collectPlaylist(nil, name, upath, recursive)
+	base := getBaseURL(r)
+	filename := "goserv"
+	if upath != "." {
+		filename = path.Base(upath)
+	}
+	if format == "m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename+"."+format))
+	w.Header().Set("Cache-Control", "no-store")
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	for _, e := range entries {
+		fmt.Fprintf(bw, "#EXTINF:-1,%s\n", strings.NewReplacer("\n", " ", "\r", " ").Replace(e.Title))
+		fmt.Fprintln(bw, base+e.Href+suffix)
+	}
+	err := bw.Flush()
+	if err != nil {
+		slog.Warn("write playlist", "path", upath, "err", err)
+	}
+}
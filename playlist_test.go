@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessToken(t *testing.T) {
+	now := time.Now()
+	token := mintAccessToken("alice", "show/s01", time.Hour)
+	var tests = []struct {
+		name  string
+		token string
+		key   string
+		now   time.Time
+		want  error
+	}{
+		{"scope itself", token, "show/s01", now, nil},
+		{"below scope", token, "show/s01/e1.mkv", now, nil},
+		{"sibling with prefix", token, "show/s01x/e1.mkv", now, errTokenScope},
+		{"parent", token, "show", now, errTokenScope},
+		{"expired", token, "show/s01/e1.mkv", now.Add(2 * time.Hour), errTokenExpired},
+		{"tampered", "x" + token, "show/s01/e1.mkv", now, errTokenInvalid},
+		{"garbage", "nope", "show/s01/e1.mkv", now, errTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyAccessToken(tt.token, tt.key, tt.now)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && claims.User != "alice" {
+				t.Errorf("user %q", claims.User)
+			}
+		})
+	}
+}
+
+func TestCheckAccessToken(t *testing.T) {
+	var user string
+	h := checkAccessToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = getRequestUser(r)
+	}))
+	serve := func(p string, token string) int {
+		r := httptest.NewRequest("GET", "/?t="+url.QueryEscape(token), nil)
+		r.URL.Path = p
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	token := mintAccessToken("bob", "music", time.Minute)
+	if code := serve("music/a.mp3", token); code != http.StatusOK || user != "bob" {
+		t.Errorf("valid token: %d, user %q", code, user)
+	}
+	if code := serve("video/a.mkv", token); code != http.StatusForbidden {
+		t.Errorf("out of scope: %d", code)
+	}
+}
+
+func TestServePlaylist(t *testing.T) {
+	dir := setupServedDir(t, "show/b.mkv", "show/a.mp4", "show/notes.txt", "show/s02/c.mkv", "show/s02/sub.srt")
+	err := os.Chtimes(filepath.Join(dir, "show", "a.mp4"), time.Now(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string) string {
+		r := httptest.NewRequest("GET", "https://media.example/show?"+query, nil)
+		r.URL.Path = "show"
+		r.SetBasicAuth("mallory", "")
+		w := httptest.NewRecorder()
+		handlePath(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d", query, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	want := "#EXTM3U\n" +
+		"#EXTINF:-1,show/a\nhttps://media.example/show%2Fa.mp4\n" +
+		"#EXTINF:-1,show/b\nhttps://media.example/show%2Fb.mkv\n"
+	if got := get("format=m3u"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := get("format=m3u&recursive=1"); !strings.HasSuffix(got, "#EXTINF:-1,show/s02/c\nhttps://media.example/show%2Fs02%2Fc.mkv\n") {
+		t.Errorf("recursive playlist lacks the subdirectory:\n%s", got)
+	}
+
+	got := get("format=m3u8&token=1")
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	u, err := url.Parse(lines[len(lines)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := url.PathUnescape(strings.TrimPrefix(u.EscapedPath(), "/"))
+	claims, err := verifyAccessToken(u.Query().Get(accessTokenParam), p, time.Now())
+	if err != nil {
+		t.Errorf("embedded token does not verify for %s: %v", p, err)
+	}
+	if claims.User != "" {
+		t.Errorf("unverified basic auth name %q signed into the token", claims.User)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most a throttled response writes between waits.
+const throttleChunk = 32 << 10
+
+// limiterIdle is how long a client bucket may go unused before it is
+// forgotten.
+const limiterIdle = 10 * time.Minute
+
+// rateClock is the time source of the limiters, replaced in tests.
+var rateClock = struct {
+	now   func() time.Time
+	sleep func(d time.Duration)
+}{time.Now, time.Sleep}
+
+// TokenBucket holds up to burst tokens and refills at rate tokens per
+// second. Tokens may be borrowed, which leaves the bucket in debt until it
+// has refilled.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long until n tokens are available.
+func (b *TokenBucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Limiter keeps a token bucket per client below an optional global one. A
+// zero rate leaves that level unlimited.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	global    *TokenBucket
+	clients   map[string]*TokenBucket
+	lastSweep time.Time
+}
+
+func NewLimiter(rate float64, burst float64, globalRate float64, globalBurst float64) *Limiter {
+	now := rateClock.now()
+	l := &Limiter{rate: rate, burst: burst, clients: map[string]*TokenBucket{}, lastSweep: now}
+	if globalRate > 0 {
+		l.global = newTokenBucket(globalRate, globalBurst, now)
+	}
+	return l
+}
+
+// buckets returns the buckets that apply to client, refilled to now.
+func (l *Limiter) buckets(client string, now time.Time) []*TokenBucket {
+	if now.Sub(l.lastSweep) > limiterIdle {
+		for k, b := range l.clients {
+			if now.Sub(b.last) > limiterIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	var bs []*TokenBucket
+	if l.rate > 0 {
+		b, ok := l.clients[client]
+		if !ok {
+			b = newTokenBucket(l.rate, l.burst, now)
+			l.clients[client] = b
+		}
+		bs = append(bs, b)
+	}
+	if l.global != nil {
+		bs = append(bs, l.global)
+	}
+	for _, b := range bs {
+		b.refill(now)
+	}
+	return bs
+}
+
+// allow takes one token from every bucket of client, or none and reports
+// how long to wait when any of them is empty.
+func (l *Limiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bs := l.buckets(client, now)
+	var wait time.Duration
+	for _, b := range bs {
+		wait = max(wait, b.wait(1))
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range bs {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// reserve takes n tokens from every bucket of client, borrowing when
+// needed, and returns how long to wait before using them.
+func (l *Limiter) reserve(client string, n float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, b := range l.buckets(client, now) {
+		wait = max(wait, b.wait(n))
+		b.tokens -= n
+	}
+	return wait
+}
+
+var (
+	requestLimiter   *Limiter
+	bandwidthLimiter *Limiter
+)
+
+// startRateLimits builds the limiters configured by the -rate-limit and
+// -bandwidth flags.
+func startRateLimits() {
+	if goServRateLimit > 0 || goServRateLimitGlobal > 0 {
+		burst := float64(max(goServRateBurst, 1))
+		requestLimiter = NewLimiter(goServRateLimit, burst, goServRateLimitGlobal, math.Max(burst, goServRateLimitGlobal))
+	}
+	if goServBandwidth > 0 || goServBandwidthGlobal > 0 {
+		// a second worth of bytes, and at least one chunk
+		bandwidthLimiter = NewLimiter(float64(goServBandwidth), float64(max(goServBandwidth, throttleChunk)),
+			float64(goServBandwidthGlobal), float64(max(goServBandwidthGlobal, throttleChunk)))
+	}
+}
+
+// getClientKey identifies the client for the limiters: the user of a
+// valid access token, or else the peer address. Basic auth names are not
+// verified, so they are not trusted to tell clients apart.
+func getClientKey(r *http.Request, now time.Time) string {
+	if user := getTokenUser(r); user != "" {
+		return "user:" + user
+	}
+	if token := r.URL.Query().Get(accessTokenParam); token != "" {
+		claims, err := verifyAccessToken(token, cleanKey(r.URL.Path), now)
+		if err == nil && claims.User != "" {
+			return "user:" + claims.User
+		}
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// limitRequests answers 429 Too Many Requests, with Retry-After in whole
+// seconds, to clients over -rate-limit or when all clients together are
+// over -rate-limit-global. Health checks are never limited.
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestLimiter == nil || r.URL.Path == "/_/healthz" || r.URL.Path == "/_/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := rateClock.now()
+		ok, wait := requestLimiter.allow(getClientKey(r, now), now)
+		if !ok {
+			setHandlerName(r, "ratelimit")
+			rateLimited.inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttledWriter paces a response body to the bandwidth limits of its
+// client. It deliberately hides ReadFrom, so sendfile cannot bypass it.
+// A throttled body can take far longer than the WriteTimeout of the
+// server, so every chunk gets that timeout afresh.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *Limiter
+	client  string
+	timeout time.Duration
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), throttleChunk)
+		wait := tw.limiter.reserve(tw.client, float64(n), rateClock.now())
+		if wait > 0 {
+			rateClock.sleep(wait)
+		}
+		if tw.timeout > 0 {
+			// not every writer supports deadlines; without one there is
+			// nothing to extend
+			_ = http.NewResponseController(tw.ResponseWriter).SetWriteDeadline(time.Now().Add(tw.timeout))
+		}
+		m, err := tw.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// throttleResponse wraps w in the bandwidth limits, when there are any.
+func throttleResponse(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if bandwidthLimiter == nil {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, limiter: bandwidthLimiter, client: getClientKey(r, rateClock.now()), timeout: getWriteTimeout(r)}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for rateClock: sleeping only moves its time forward.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func withFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	c := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	saved := rateClock
+	rateClock.now = func() time.Time { return c.t }
+	rateClock.sleep = func(d time.Duration) {
+		c.slept += d
+		c.advance(d)
+	}
+	t.Cleanup(func() { rateClock = saved })
+	return c
+}
+
+func TestLimiterAllow(t *testing.T) {
+	clock := withFakeClock(t)
+	l := NewLimiter(2, 3, 0, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", clock.t); !ok {
+			t.Fatalf("burst request %d denied", i+1)
+		}
+	}
+	ok, wait := l.allow("a", clock.t)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("over burst: got %v %v", ok, wait)
+	}
+	if ok, _ := l.allow("b", clock.t); !ok {
+		t.Errorf("other client limited")
+	}
+	clock.advance(499 * time.Millisecond)
+	if ok, _ := l.allow("a", clock.t); ok {
+		t.Errorf("allowed before refill")
+	}
+	clock.advance(time.Millisecond)
+	if ok, _ := l.allow("a", clock.t); !ok {
+		t.Errorf("denied after refill")
+	}
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", clock.t); !ok {
+			t.Errorf("refill beyond burst: request %d denied", i+1)
+		}
+	}
+	if ok, _ := l.allow("a", clock.t); ok {
+		t.Errorf("bucket refilled beyond burst")
+	}
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	clock := withFakeClock(t)
+	l := NewLimiter(10, 10, 1, 2)
+	if ok, _ := l.allow("a", clock.t); !ok {
+		t.Fatal("first request denied")
+	}
+	if ok, _ := l.allow("b", clock.t); !ok {
+		t.Fatal("second request denied")
+	}
+	ok, wait := l.allow("c", clock.t)
+	if ok || wait != time.Second {
+		t.Errorf("global limit: got %v %v", ok, wait)
+	}
+	// a denied request must not use up the client's own tokens
+	if got := l.clients["c"].tokens; got != 10 {
+		t.Errorf("client bucket charged for a denied request: %v", got)
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	clock := withFakeClock(t)
+	saved := requestLimiter
+	requestLimiter = NewLimiter(1, 2, 0, 0)
+	defer func() { requestLimiter = saved }()
+	handler := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(target string, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	for _, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if w := get("/a", "192.0.2.1:1000"); w.Code != want {
+			t.Fatalf("got %d, want %d", w.Code, want)
+		}
+	}
+	clock.advance(200 * time.Millisecond)
+	w := get("/a", "192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get("/a", "192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("other address limited: %d", w.Code)
+	}
+	if w := get("/_/healthz", "192.0.2.1:1000"); w.Code != http.StatusOK {
+		t.Errorf("health check limited: %d", w.Code)
+	}
+	// the user of a valid token is limited on its own, not by address
+	token := mintAccessToken("alice", ".", time.Hour)
+	if w := get("/a?t="+token, "192.0.2.1:1000"); w.Code != http.StatusOK {
+		t.Errorf("token user limited by address: %d", w.Code)
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	var tests = []struct {
+		name    string
+		limiter func() *Limiter
+		clients int
+		size    int
+		want    time.Duration
+	}{
+		// the first 64 KiB are the burst, the other 192 KiB take 3 seconds
+		{"per client", func() *Limiter { return NewLimiter(64<<10, 64<<10, 0, 0) }, 1, 256 << 10, 3 * time.Second},
+		// two clients of 128 KiB share 64 KiB/s
+		{"global", func() *Limiter { return NewLimiter(0, 0, 64<<10, 64<<10) }, 2, 128 << 10, 3 * time.Second},
+		{"within burst", func() *Limiter { return NewLimiter(64<<10, 64<<10, 0, 0) }, 1, 64 << 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := withFakeClock(t)
+			l := tt.limiter()
+			data := bytes.Repeat([]byte("x"), tt.size)
+			for i := 0; i < tt.clients; i++ {
+				w := httptest.NewRecorder()
+				tw := &throttledWriter{ResponseWriter: w, limiter: l, client: string(rune('a' + i))}
+				n, err := io.Copy(tw, bytes.NewReader(data))
+				if err != nil || n != int64(tt.size) || w.Body.Len() != tt.size {
+					t.Fatalf("copied %d of %d: %v", n, tt.size, err)
+				}
+			}
+			if clock.slept != tt.want {
+				t.Errorf("slept %v, want %v", clock.slept, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeFileThrottled(t *testing.T) {
+	clock := withFakeClock(t)
+	setupServedDir(t, "a.txt")
+	saved := bandwidthLimiter
+	// 7 bytes at 1 byte per second after a 3 byte burst
+	bandwidthLimiter = NewLimiter(1, 3, 0, 0)
+	defer func() { bandwidthLimiter = saved }()
+	w := httptest.NewRecorder()
+	http.StripPrefix("/", http.HandlerFunc(handlePath)).ServeHTTP(w, httptest.NewRequest("GET", "/a.txt", nil))
+	if w.Body.String() != "content" {
+		t.Fatalf("got %q", w.Body.String())
+	}
+	if clock.slept != 4*time.Second {
+		t.Errorf("slept %v, want 4s", clock.slept)
+	}
+}
+
+func TestThrottledOutlastsWriteTimeout(t *testing.T) {
+	dir := setupServedDir(t)
+	data := bytes.Repeat([]byte("x"), 96<<10)
+	err := os.WriteFile(filepath.Join(dir, "big.bin"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := bandwidthLimiter
+	// 32 KiB of burst, then 64 KiB at 64 KiB/s: five times the WriteTimeout
+	bandwidthLimiter = NewLimiter(64<<10, throttleChunk, 0, 0)
+	defer func() { bandwidthLimiter = saved }()
+	srv := httptest.NewUnstartedServer(http.StripPrefix("/", http.HandlerFunc(handlePath)))
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil || len(body) != len(data) {
+		t.Fatalf("got %d of %d bytes: %v", len(body), len(data), err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout of schema version 7:
+//
+//	meta        schema_version -> decimal version
+//	            share_secret -> share link HMAC key without -token-secret
+//	watched     path -> JSON WatchRecord
+//	dirstats    directory path -> JSON DirStats
+//	identities  file identity -> JSON IdentityLink
+//	positions   user NUL path -> JSON PlaybackPosition
+//	shares      share ID -> JSON Share
+//	uploads     upload ID -> JSON TusUpload
+//	audit       zero padded nanoseconds "-" random hex -> JSON AuditEvent
+//
+// Version 0 is any database written before versioning existed: a single
+// MyBucket holding RFC3339 strings or JSON records, optionally alongside
+// DirBucket.
+const (
+	metaBucket     = "meta"
+	watchedBucket  = "watched"
+	dirStatsBucket = "dirstats"
+	identityBucket = "identities"
+	positionBucket = "positions"
+	shareBucket    = "shares"
+	uploadBucket   = "uploads"
+	auditBucket    = "audit"
+)
+
+var (
+	schemaVersionKey = []byte("schema_version")
+
+	legacyBucket    = []byte("MyBucket")
+	legacyDirBucket = []byte("DirBucket")
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *bolt.Tx) error
+}
+
+// migrations are applied in order, each in its own transaction together
+// with the bump of schema_version. Append only; never edit a released one.
+var migrations = []migration{
+	{1, "move MyBucket to watched as JSON records", migrateWatchedRecords},
+	{2, "rebuild directory aggregates into dirstats", migrateDirStats},
+	{3, "add identities bucket", migrateIdentities},
+	{4, "add positions bucket", migratePositions},
+	{5, "add shares bucket", migrateShares},
+	{6, "add uploads bucket", migrateUploads},
+	{7, "add audit bucket", migrateAudit},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func getSchemaVersion(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return 0, nil
+	}
+	v := b.Get(schemaVersionKey)
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+	return b.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+func isEmptyDB(tx *bolt.Tx) bool {
+	empty := true
+	_ = tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		empty = false
+		return nil
+	})
+	return empty
+}
+
+// openBolt opens the database at name and upgrades it to the latest schema.
+func openBolt(name string) (*bolt.DB, error) {
+	db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = migrateBolt(db, name)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateBolt applies the pending migrations. Databases holding data are
+// copied to name.v<version>-<timestamp>.bak first.
+func migrateBolt(db *bolt.DB, name string) error {
+	var version int
+	var empty bool
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = getSchemaVersion(tx)
+		empty = isEmptyDB(tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	latest := latestSchemaVersion()
+	if version > latest {
+		return fmt.Errorf("database schema v%d is newer than supported v%d", version, latest)
+	}
+	if version == latest {
+		return nil
+	}
+	if !empty {
+		backup := fmt.Sprintf("%s.v%d-%s.bak", name, version, time.Now().Format("20060102T150405"))
+		err = backupBolt(db, backup)
+		if err != nil {
+			return fmt.Errorf("pre-migration backup: %w", err)
+		}
+		slog.Info("bolt backup before migration", "file", backup)
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			err := m.up(tx)
+			if err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		slog.Info("bolt migrated", "version", m.version, "migration", m.name)
+	}
+	return nil
+}
+
+// backupBolt writes a consistent copy of the database to dst.
+func backupBolt(db *bolt.DB, dst string) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(dst, 0600)
+	})
+}
+
+func migrateWatchedRecords(tx *bolt.Tx) error {
+	dst, err := tx.CreateBucketIfNotExists([]byte(watchedBucket))
+	if err != nil {
+		return err
+	}
+	src := tx.Bucket(legacyBucket)
+	if src != nil {
+		err = src.ForEach(func(k, v []byte) error {
+			rec, ok := decodeRecord(v)
+			if !ok {
+				slog.Warn("dropping undecodable record", "key", string(k))
+				return nil
+			}
+			return dst.Put(k, encodeRecord(rec))
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.DeleteBucket(legacyBucket)
+		if err != nil {
+			return err
+		}
+	}
+	if tx.Bucket(legacyDirBucket) != nil {
+		return tx.DeleteBucket(legacyDirBucket)
+	}
+	return nil
+}
+
+func migrateDirStats(tx *bolt.Tx) error {
+	return rebuildDirStats(boltTx{tx})
+}
+
+func migrateIdentities(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(identityBucket))
+	return err
+}
+
+func migratePositions(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(positionBucket))
+	return err
+}
+
+func migrateShares(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(shareBucket))
+	return err
+}
+
+func migrateUploads(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(uploadBucket))
+	return err
+}
+
+func migrateAudit(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(auditBucket))
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func copyFixture(t *testing.T, fixture string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "fixtures", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "bolt.db")
+	err = os.WriteFile(name, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func readBackups(t *testing.T, name string) []string {
+	t.Helper()
+	backups, err := filepath.Glob(name + ".v*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+func checkMigrated(t *testing.T, db *bolt.DB, records map[string]bool, dirs map[string]int) {
+	t.Helper()
+	err := db.View(func(tx *bolt.Tx) error {
+		version, err := getSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version != latestSchemaVersion() {
+			t.Errorf("schema version %d, want %d", version, latestSchemaVersion())
+		}
+		for _, legacy := range [][]byte{legacyBucket, legacyDirBucket} {
+			if tx.Bucket(legacy) != nil {
+				t.Errorf("legacy bucket %s still present", legacy)
+			}
+		}
+		b := tx.Bucket([]byte(watchedBucket))
+		n := 0
+		_ = b.ForEach(func(k, v []byte) error { n++; return nil })
+		if n != len(records) {
+			t.Errorf("got %d records, want %d", n, len(records))
+		}
+		for k, watched := range records {
+			rec, ok := decodeRecord(b.Get([]byte(k)))
+			if !ok || b.Get([]byte(k))[0] != '{' {
+				t.Errorf("%s: not a JSON record", k)
+			}
+			if rec.Watched != watched {
+				t.Errorf("%s: watched %v, want %v", k, rec.Watched, watched)
+			}
+		}
+		for k, want := range dirs {
+			if got := getDirStats(boltTx{tx}, k).Watched; got != want {
+				t.Errorf("dirstats %s: watched %d, want %d", k, got, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateTimestampFixture(t *testing.T) {
+	name := copyFixture(t, "v0-timestamps.db")
+	db, err := openBolt(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, db,
+		map[string]bool{"movie.mkv": true, "show/s01/e1.mkv": true, "show/s01/e2.mkv": true, "show": true},
+		map[string]int{"show/s01": 2, "show": 2, ".": 4},
+	)
+	db.Close()
+	if got := len(readBackups(t, name)); got != 1 {
+		t.Fatalf("want 1 pre-migration backup, got %d", got)
+	}
+
+	// reopening an up to date database neither migrates nor backs up again
+	db, err = openBolt(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if got := len(readBackups(t, name)); got != 1 {
+		t.Fatalf("want 1 pre-migration backup after reopen, got %d", got)
+	}
+}
+
+func TestMigrateRecordFixture(t *testing.T) {
+	name := copyFixture(t, "v0-records.db")
+	db, err := openBolt(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the stale DirBucket count of 7 is replaced by a rebuild from records
+	checkMigrated(t, db,
+		map[string]bool{"movie.mkv": false, "show/s01/e1.mkv": true, "show/s01": true},
+		map[string]int{"show/s01": 1, "show": 1, ".": 1},
+	)
+	backup, err := bolt.Open(readBackups(t, name)[0], 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	err = backup.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(legacyBucket) == nil {
+			t.Errorf("backup does not hold the original layout")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bolt.db")
+	db, err := openBolt(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkMigrated(t, db, map[string]bool{}, map[string]int{})
+	if got := len(readBackups(t, name)); got != 0 {
+		t.Fatalf("fresh database backed up %d times", got)
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bolt.db")
+	db, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return setSchemaVersion(tx, latestSchemaVersion()+1)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openBolt(name)
+	if err == nil {
+		t.Fatal("opened a database with a newer schema")
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	shareCookieName = "goserv_share"
+	// shareDownloadCookie marks a download already counted against the
+	// limit of a share, so that the range requests of one player or
+	// download manager count once per shareSessionTTL
+	shareDownloadCookie = "goserv_share_dl"
+	shareSessionTTL     = 6 * time.Hour
+)
+
+// shareSecretKey is the meta bucket key of the share secret generated when
+// -token-secret is not set.
+const shareSecretKey = "share_secret"
+
+var (
+	errShareNotFound  = errors.New("share not found")
+	errShareExpired   = errors.New("share expired")
+	errShareExhausted = errors.New("share download limit reached")
+)
+
+// Share is a link handing out one file or directory without an account,
+// kept in the shares bucket under its ID until it expires or is revoked.
+type Share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Salt         string    `json:"salt,omitempty"` // legacy SHA-256 hashes only
+	PasswordHash string    `json:"password_hash,omitempty"`
+}
+
+func (s Share) hasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+var (
+	shareSecretMu sync.Mutex
+	shareSecret   []byte
+)
+
+// getShareSecret returns the HMAC key of share links: -token-secret, or
+// else a random key generated once and kept in the meta bucket, since
+// shares outlive the process.
+func getShareSecret() []byte {
+	if goServTokenSecret != "" {
+		return getTokenSecret()
+	}
+	shareSecretMu.Lock()
+	defer shareSecretMu.Unlock()
+	if shareSecret != nil {
+		return shareSecret
+	}
+	err := GetBoltInstance().store.Update(context.Background(), func(tx StoreTx) error {
+		v := tx.Get(metaBucket, shareSecretKey)
+		if v == nil {
+			v = []byte(randomHex(32))
+			err := tx.Put(metaBucket, shareSecretKey, v)
+			if err != nil {
+				return err
+			}
+		}
+		shareSecret = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		// links signed now will not survive a restart, but still work
+		slog.Error("share secret", "err", err)
+		shareSecret = nil
+		return getTokenSecret()
+	}
+	return shareSecret
+}
+
+// Signature authenticates the share URL; it changes when the share is
+// recreated with another path or expiry.
+func (s Share) Signature() string {
+	mac := hmac.New(sha256.New, getShareSecret())
+	fmt.Fprintf(mac, "share\x00%s\x00%s\x00%d", s.ID, s.Path, s.Expires.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// URL is the address of the share, absolute when -public-url is set.
+func (s Share) URL() string {
+	return strings.TrimSuffix(goServPublicURL, "/") + "/_/s/" + s.ID + "/" + s.Signature() + "/"
+}
+
+// hashLegacySharePassword is the salted SHA-256 of shares created before
+// passwords were hashed with bcrypt; only checked, never written.
+func hashLegacySharePassword(salt string, password string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s Share) checkPassword(password string) bool {
+	if s.Salt != "" {
+		return subtle.ConstantTimeCompare([]byte(hashLegacySharePassword(s.Salt, password)), []byte(s.PasswordHash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// unlockToken is the cookie value proving the password of s was entered.
+func (s Share) unlockToken() string {
+	mac := hmac.New(sha256.New, getShareSecret())
+	fmt.Fprintf(mac, "unlock\x00%s\x00%s", s.ID, s.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// downloadToken is the cookie value proving a download of key was
+// counted, valid until exp.
+func (s Share) downloadToken(key string, exp int64) string {
+	mac := hmac.New(sha256.New, getShareSecret())
+	fmt.Fprintf(mac, "download\x00%s\x00%s\x00%d", s.ID, key, exp)
+	return strconv.FormatInt(exp, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (s Share) checkDownloadToken(key string, token string, now time.Time) bool {
+	e, _, _ := strings.Cut(token, ".")
+	exp, err := strconv.ParseInt(e, 10, 64)
+	return err == nil && now.Unix() < exp && hmac.Equal([]byte(token), []byte(s.downloadToken(key, exp)))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// createShare stores a new share of key.
+func createShare(key string, ttl time.Duration, maxDownloads int, password string) (Share, error) {
+	now := time.Now()
+	s := Share{
+		ID:           randomHex(12),
+		Path:         key,
+		Created:      now,
+		Expires:      now.Add(ttl),
+		MaxDownloads: maxDownloads,
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return s, err
+		}
+		s.PasswordHash = string(hash)
+	}
+	v, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	return s, GetBoltInstance().store.Put(context.Background(), shareBucket, s.ID, v)
+}
+
+func getShare(id string) (Share, error) {
+	var s Share
+	v, err := GetBoltInstance().store.Get(context.Background(), shareBucket, id)
+	if err != nil {
+		return s, err
+	}
+	if v == nil {
+		return s, errShareNotFound
+	}
+	err = json.Unmarshal(v, &s)
+	return s, err
+}
+
+func revokeShare(id string) error {
+	return GetBoltInstance().store.Delete(context.Background(), shareBucket, id)
+}
+
+// listShares returns the active shares, newest first, dropping expired
+// ones from the bucket on the way.
+func listShares(now time.Time) ([]Share, error) {
+	var shares []Share
+	err := GetBoltInstance().store.Update(context.Background(), func(tx StoreTx) error {
+		var expired []string
+		err := tx.Iterate(shareBucket, "", func(k string, v []byte) error {
+			var s Share
+			if json.Unmarshal(v, &s) != nil || !now.Before(s.Expires) {
+				expired = append(expired, k)
+				return nil
+			}
+			shares = append(shares, s)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = tx.Delete(shareBucket, k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.After(shares[j].Created)
+	})
+	return shares, err
+}
+
+// claimShareDownload counts a download against the limit of the share.
+func claimShareDownload(id string, now time.Time) error {
+	return GetBoltInstance().store.Update(context.Background(), func(tx StoreTx) error {
+		var s Share
+		v := tx.Get(shareBucket, id)
+		if v == nil || json.Unmarshal(v, &s) != nil {
+			return errShareNotFound
+		}
+		if !now.Before(s.Expires) {
+			return errShareExpired
+		}
+		if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+			return errShareExhausted
+		}
+		s.Downloads++
+		v, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		return tx.Put(shareBucket, id, v)
+	})
+}
+
+type ShareEntry struct {
+	Name string
+	Href string
+	Dir  bool
+}
+
+type SharePageData struct {
+	PageTitle    string
+	NeedPassword bool
+	WrongPass    bool
+	Entries      []ShareEntry
+}
+
+func renderSharePage(w http.ResponseWriter, status int, data SharePageData) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tmpl := template.Must(template.ParseFS(embedded, "assets/templates/share.html"))
+	err := tmpl.Execute(w, data)
+	if err != nil {
+		slog.Error("template execute", "path", "share", "err", err)
+	}
+}
+
+// handleShare serves /_/s/<id>/<signature>/<path below the share>. A valid
+// link grants access to the shared file or directory and nothing outside
+// it.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "share")
+	rest := strings.TrimPrefix(r.URL.Path, "/_/s/")
+	id, rest, _ := strings.Cut(rest, "/")
+	sig, sub, _ := strings.Cut(rest, "/")
+	s, err := getShare(id)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(s.Signature())) {
+		http.NotFound(w, r)
+		return
+	}
+	now := time.Now()
+	if !now.Before(s.Expires) {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+	base := "/_/s/" + s.ID + "/" + sig + "/"
+	if s.hasPassword() {
+		c, err := r.Cookie(shareCookieName)
+		unlocked := err == nil && hmac.Equal([]byte(c.Value), []byte(s.unlockToken()))
+		if !unlocked {
+			if r.Method != http.MethodPost {
+				renderSharePage(w, http.StatusUnauthorized, SharePageData{PageTitle: "shared", NeedPassword: true})
+				return
+			}
+			if !s.checkPassword(r.FormValue("password")) {
+				renderSharePage(w, http.StatusUnauthorized, SharePageData{PageTitle: "shared", NeedPassword: true, WrongPass: true})
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareCookieName,
+				Value:    s.unlockToken(),
+				Path:     base,
+				Expires:  s.Expires,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	key := s.Path
+	if subKey := cleanKey(sub); subKey != "." {
+		key = getKey(s.Path, subKey)
+	}
+	if !inScope(key, s.Path) || isHiddenKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	name := filepath.Join(goServDir, filepath.FromSlash(key))
+	fi, err := os.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if fi.IsDir() {
+		if sub != "" && !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		renderSharePage(w, http.StatusOK, SharePageData{PageTitle: path.Base(key), Entries: getShareEntries(name, key)})
+		return
+	}
+	// every request outside a counted session is charged, whatever range
+	// it asks for
+	c, err := r.Cookie(shareDownloadCookie)
+	if r.Method == http.MethodGet && (err != nil || !s.checkDownloadToken(key, c.Value, now)) {
+		err = claimShareDownload(s.ID, now)
+		if errors.Is(err, errShareExhausted) {
+			http.Error(w, "This link has reached its download limit", http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		exp := now.Add(shareSessionTTL)
+		if s.Expires.Before(exp) {
+			exp = s.Expires
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareDownloadCookie,
+			Value:    s.downloadToken(key, exp.Unix()),
+			Path:     r.URL.Path,
+			Expires:  exp,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	sendFile(w, r, name)
+}
+
+// getShareKey maps a share request to the served path it asks for, for
+// the audit trail.
+func getShareKey(r *http.Request) string {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/_/s/"), "/")
+	_, sub, _ := strings.Cut(rest, "/")
+	s, err := getShare(id)
+	if err != nil {
+		return ""
+	}
+	return cleanKey(path.Join(s.Path, sub))
+}
+
+func getShareEntries(name string, key string) []ShareEntry {
+	files, err := os.ReadDir(name)
+	if err != nil {
+		slog.Warn("read dir", "dir", name, "err", err)
+	}
+	var entries []ShareEntry
+	for _, f := range files {
+		if isHiddenKey(getKey(key, f.Name())) {
+			continue
+		}
+		href := url.PathEscape(f.Name())
+		if f.IsDir() {
+			href += "/"
+		}
+		entries = append(entries, ShareEntry{Name: f.Name(), Href: href, Dir: f.IsDir()})
+	}
+	return entries
+}
+
+type SharesPageData struct {
+	PageTitle string
+	CSRFToken string
+	Message   string
+	Shares    []Share
+	Now       time.Time
+}
+
+// handleSharesAdmin is the admin page listing the active shares, with
+// forms to create and revoke them.
+func handleSharesAdmin(w http.ResponseWriter, r *http.Request) {
+	data := SharesPageData{PageTitle: "shares", CSRFToken: getCSRFToken(w, r), Now: time.Now()}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		data.Message, status = applySharesForm(r)
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	data.Shares, err = listShares(data.Now)
+	if err != nil {
+		slog.Error("list shares", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	tmpl := template.Must(template.ParseFS(embedded, "assets/templates/shares.html"))
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		slog.Error("template execute", "path", "shares", "err", err)
+	}
+}
+
+func applySharesForm(r *http.Request) (string, int) {
+	if !checkCSRF(r) {
+		return "Invalid CSRF token", http.StatusForbidden
+	}
+	switch r.FormValue("action") {
+	case "create":
+		key := cleanKey(r.FormValue("path"))
+		if _, err := os.Stat(filepath.Join(goServDir, filepath.FromSlash(key))); err != nil {
+			return fmt.Sprintf("%s does not exist", key), http.StatusBadRequest
+		}
+		ttl, err := time.ParseDuration(r.FormValue("ttl"))
+		if err != nil || ttl <= 0 {
+			return "Invalid expiry", http.StatusBadRequest
+		}
+		limit := 0
+		if v := r.FormValue("max_downloads"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				return "Invalid download limit", http.StatusBadRequest
+			}
+		}
+		s, err := createShare(key, ttl, limit, r.FormValue("password"))
+		if err != nil {
+			slog.Error("create share", "path", key, "err", err)
+			return "Cannot create share", http.StatusInternalServerError
+		}
+		slog.Info("share created", "id", s.ID, "path", key, "expires", s.Expires)
+		return "Created " + s.URL(), http.StatusOK
+	case "revoke":
+		id := r.FormValue("id")
+		err := revokeShare(id)
+		if err != nil {
+			slog.Error("revoke share", "id", id, "err", err)
+			return "Cannot revoke share", http.StatusInternalServerError
+		}
+		slog.Info("share revoked", "id", id)
+		return "Revoked " + id, http.StatusOK
+	}
+	return "Unknown action", http.StatusBadRequest
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveShare(t *testing.T, method string, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handleShare(w, r)
+	return w
+}
+
+func TestShareScope(t *testing.T) {
+	setupServedDir(t, "pub/a.txt", "pub/sub/b.txt", "private.txt")
+	s, err := createShare("pub", time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := s.URL()
+	var tests = []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"listing", link, http.StatusOK},
+		{"file", link + "a.txt", http.StatusOK},
+		{"nested", link + "sub/b.txt", http.StatusOK},
+		{"escape", link + "../private.txt", http.StatusNotFound},
+		{"encoded escape", link + "..%2Fprivate.txt", http.StatusNotFound},
+		{"bad signature", "/_/s/" + s.ID + "/AAAA/a.txt", http.StatusNotFound},
+		{"unknown id", "/_/s/nope/" + s.Signature() + "/a.txt", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveShare(t, "GET", tt.target, nil); w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+	if w := serveShare(t, "GET", link, nil); !strings.Contains(w.Body.String(), `href="sub/"`) {
+		t.Errorf("listing lacks the subdirectory:\n%s", w.Body.String())
+	}
+}
+
+func TestShareRootHidesServerDirs(t *testing.T) {
+	setupServedDir(t, "a.txt", trashDir+"/1/gone.txt", uploadStagingDir+"/part", ".hidden/secret.txt")
+	saved := goIgnoreFiles
+	goIgnoreFiles = append(arrayFlags{}, ".hidden")
+	defer func() { goIgnoreFiles = saved }()
+	s, err := createShare(".", time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := s.URL()
+	var tests = []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"file", link + "a.txt", http.StatusOK},
+		{"trash", link + trashDir + "/1/gone.txt", http.StatusNotFound},
+		{"trash listing", link + trashDir + "/", http.StatusNotFound},
+		{"staging", link + uploadStagingDir + "/part", http.StatusNotFound},
+		{"below ignored", link + ".hidden/secret.txt", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveShare(t, "GET", tt.target, nil); w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+	body := serveShare(t, "GET", link, nil).Body.String()
+	if strings.Contains(body, trashDir) || strings.Contains(body, uploadStagingDir) || strings.Contains(body, ".hidden") {
+		t.Errorf("listing shows hidden entries:\n%s", body)
+	}
+}
+
+func TestShareSecretPersists(t *testing.T) {
+	s, err := createShare("kept.txt", time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := s.URL()
+	// a restart forgets the cached secret and the per process token secret
+	shareSecretMu.Lock()
+	shareSecret = nil
+	shareSecretMu.Unlock()
+	if s.URL() != link {
+		t.Errorf("link changed after reload: %s, want %s", s.URL(), link)
+	}
+	if string(getShareSecret()) == string(getTokenSecret()) {
+		t.Errorf("share secret is the per process token secret")
+	}
+}
+
+func TestShareLimitsAndRevoke(t *testing.T) {
+	setupServedDir(t, "limited.txt")
+	s, err := createShare("limited.txt", time.Hour, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusGone} {
+		if w := serveShare(t, "GET", s.URL(), nil); w.Code != want {
+			t.Errorf("download %d: got %d, want %d", i+1, w.Code, want)
+		}
+	}
+
+	// a range not starting at 0 is charged too, unless the download was
+	// already counted for this client
+	s, err = createShare("limited.txt", time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranged := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", s.URL(), nil)
+		r.Header.Set("Range", "bytes=1-")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handleShare(w, r)
+		return w
+	}
+	w := ranged()
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("first range: got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if w := ranged(); w.Code != http.StatusGone {
+		t.Errorf("uncounted range: got %d, want 410", w.Code)
+	}
+	if w := ranged(cookies...); w.Code != http.StatusPartialContent {
+		t.Errorf("range in a counted session: got %d", w.Code)
+	}
+
+	s, err = createShare("limited.txt", time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = revokeShare(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveShare(t, "GET", s.URL(), nil); w.Code != http.StatusNotFound {
+		t.Errorf("revoked share: got %d", w.Code)
+	}
+
+	s, err = createShare("limited.txt", -time.Second, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveShare(t, "GET", s.URL(), nil); w.Code != http.StatusGone {
+		t.Errorf("expired share: got %d", w.Code)
+	}
+	shares, err := listShares(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range shares {
+		if sh.ID == s.ID {
+			t.Errorf("expired share still listed")
+		}
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	setupServedDir(t, "secret.txt")
+	s, err := createShare("secret.txt", time.Hour, 0, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveShare(t, "GET", s.URL(), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no password: got %d", w.Code)
+	}
+	if w := serveShare(t, "POST", s.URL(), url.Values{"password": {"wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d", w.Code)
+	}
+	w := serveShare(t, "POST", s.URL(), url.Values{"password": {"hunter2"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("right password: got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies", len(cookies))
+	}
+	if w := serveShare(t, "GET", s.URL(), nil, cookies[0]); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("unlocked: got %d %q", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(s.PasswordHash, "$2a$") {
+		t.Errorf("password not hashed with bcrypt: %s", s.PasswordHash)
+	}
+	legacy := Share{Salt: "salt", PasswordHash: hashLegacySharePassword("salt", "hunter2")}
+	if !legacy.checkPassword("hunter2") || legacy.checkPassword("wrong") {
+		t.Errorf("legacy password check failed")
+	}
+}
+
+func TestSharesAdmin(t *testing.T) {
+	setupServedDir(t, "admin.txt")
+	saved := goServAdminToken
+	goServAdminToken = "s3cret"
+	defer func() { goServAdminToken = saved }()
+
+	post := func(form url.Values, user string, pass string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/shares", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+		if pass != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		adminMux.ServeHTTP(w, r)
+		return w
+	}
+	form := url.Values{"csrf": {"t0ken"}, "action": {"create"}, "path": {"admin.txt"}, "ttl": {"1h"}}
+	if w := post(form, "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no credentials: got %d", w.Code)
+	}
+	w := post(form, "admin", "s3cret")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Created /_/s/") {
+		t.Fatalf("create: got %d\n%s", w.Code, w.Body.String())
+	}
+	form.Set("csrf", "bad")
+	if w := post(form, "admin", "s3cret"); w.Code != http.StatusForbidden {
+		t.Errorf("bad csrf: got %d", w.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var errReadOnlyTx = errors.New("write in read-only transaction")
+
+// Store is the storage backend for watched state: named buckets of string
+// keys holding byte values, iterated in key order. Buckets spring into
+// existence on first Put.
+type Store interface {
+	Get(ctx context.Context, bucket string, key string) ([]byte, error)
+	Put(ctx context.Context, bucket string, key string, value []byte) error
+	Delete(ctx context.Context, bucket string, key string) error
+	// List returns the keys of bucket starting with prefix.
+	List(ctx context.Context, bucket string, prefix string) ([]string, error)
+	// Iterate calls fn for every key of bucket starting with prefix, stopping
+	// at the first error.
+	Iterate(ctx context.Context, bucket string, prefix string, fn func(key string, value []byte) error) error
+	// View and Update run fn in a read-only or read-write transaction. An
+	// Update whose fn returns an error leaves the store untouched.
+	View(ctx context.Context, fn func(tx StoreTx) error) error
+	Update(ctx context.Context, fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// StoreTx is the view of a Store inside a transaction. Values returned by
+// Get and passed to Iterate stay valid after the transaction ends. Iterate
+// callbacks must not modify the bucket being iterated.
+type StoreTx interface {
+	Get(bucket string, key string) []byte
+	Put(bucket string, key string, value []byte) error
+	Delete(bucket string, key string) error
+	Iterate(bucket string, prefix string, fn func(key string, value []byte) error) error
+	// Seek calls fn for every key of bucket from start on, in key order,
+	// stopping at the first error.
+	Seek(bucket string, start string, fn func(key string, value []byte) error) error
+}
+
+// txRunner is the part of a Store every backend implements itself;
+// storeOps derives the single operation methods from it.
+type txRunner interface {
+	View(ctx context.Context, fn func(tx StoreTx) error) error
+	Update(ctx context.Context, fn func(tx StoreTx) error) error
+}
+
+type storeOps struct {
+	r txRunner
+}
+
+func (so storeOps) Get(ctx context.Context, bucket string, key string) ([]byte, error) {
+	var res []byte
+	err := so.r.View(ctx, func(tx StoreTx) error {
+		res = tx.Get(bucket, key)
+		return nil
+	})
+	return res, err
+}
+
+func (so storeOps) Put(ctx context.Context, bucket string, key string, value []byte) error {
+	return so.r.Update(ctx, func(tx StoreTx) error {
+		return tx.Put(bucket, key, value)
+	})
+}
+
+func (so storeOps) Delete(ctx context.Context, bucket string, key string) error {
+	return so.r.Update(ctx, func(tx StoreTx) error {
+		return tx.Delete(bucket, key)
+	})
+}
+
+func (so storeOps) List(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	var keys []string
+	err := so.Iterate(ctx, bucket, prefix, func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+func (so storeOps) Iterate(ctx context.Context, bucket string, prefix string, fn func(key string, value []byte) error) error {
+	return so.r.View(ctx, func(tx StoreTx) error {
+		return tx.Iterate(bucket, prefix, func(key string, value []byte) error {
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+			return fn(key, value)
+		})
+	})
+}
+
+// openStore opens the backend selected by -store.
+func openStore(kind string) (Store, error) {
+	switch kind {
+	case "bolt":
+		return openBoltStore(goServBoltDB)
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return openSQLStore(goServStoreDriver, goServStoreDSN)
+	}
+	return nil, fmt.Errorf("unknown store %q, want bolt, memory or sqlite", kind)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore is the default Store, a single bbolt file upgraded in place by
+// the migrations in schema.go.
+type boltStore struct {
+	storeOps
+	db *bolt.DB
+}
+
+func openBoltStore(name string) (*boltStore, error) {
+	db, err := openBolt(name)
+	if err != nil {
+		return nil, err
+	}
+	return newBoltStore(db), nil
+}
+
+func newBoltStore(db *bolt.DB) *boltStore {
+	bs := &boltStore{db: db}
+	bs.storeOps = storeOps{r: bs}
+	return bs
+}
+
+func (bs *boltStore) View(ctx context.Context, fn func(tx StoreTx) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return bs.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bs *boltStore) Update(ctx context.Context, fn func(tx StoreTx) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (bs *boltStore) Close() error {
+	return bs.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (bt boltTx) Get(bucket string, key string) []byte {
+	b := bt.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func (bt boltTx) Put(bucket string, key string, value []byte) error {
+	b, err := bt.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+func (bt boltTx) Delete(bucket string, key string) error {
+	b := bt.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func (bt boltTx) Iterate(bucket string, prefix string, fn func(key string, value []byte) error) error {
+	b := bt.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	p := []byte(prefix)
+	c := b.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		err := fn(string(k), append([]byte(nil), v...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bt boltTx) Seek(bucket string, start string, fn func(key string, value []byte) error) error {
+	b := bt.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+		err := fn(string(k), append([]byte(nil), v...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps everything in process memory. It is meant for tests
+// and throwaway instances; nothing survives a restart.
+type memoryStore struct {
+	storeOps
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	ms := &memoryStore{buckets: map[string]map[string][]byte{}}
+	ms.storeOps = storeOps{r: ms}
+	return ms
+}
+
+func (ms *memoryStore) View(ctx context.Context, fn func(tx StoreTx) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return fn(&memoryTx{ms: ms})
+}
+
+// Update stages writes in the transaction and applies them only when fn
+// succeeds.
+func (ms *memoryStore) Update(ctx context.Context, fn func(tx StoreTx) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	tx := &memoryTx{ms: ms, staged: map[string]map[string][]byte{}}
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	for bucket, kv := range tx.staged {
+		b, ok := ms.buckets[bucket]
+		if !ok {
+			b = map[string][]byte{}
+			ms.buckets[bucket] = b
+		}
+		for k, v := range kv {
+			if v == nil {
+				delete(b, k)
+			} else {
+				b[k] = v
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	ms *memoryStore
+	// staged holds pending writes, nil values mark deletions
+	staged map[string]map[string][]byte
+}
+
+func (mt *memoryTx) Get(bucket string, key string) []byte {
+	if kv, ok := mt.staged[bucket]; ok {
+		if v, ok := kv[key]; ok {
+			return append([]byte(nil), v...)
+		}
+	}
+	v, ok := mt.ms.buckets[bucket][key]
+	if !ok {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func (mt *memoryTx) stage(bucket string, key string, value []byte) {
+	kv, ok := mt.staged[bucket]
+	if !ok {
+		kv = map[string][]byte{}
+		mt.staged[bucket] = kv
+	}
+	kv[key] = value
+}
+
+func (mt *memoryTx) Put(bucket string, key string, value []byte) error {
+	if mt.staged == nil {
+		return errReadOnlyTx
+	}
+	mt.stage(bucket, key, append([]byte{}, value...))
+	return nil
+}
+
+func (mt *memoryTx) Delete(bucket string, key string) error {
+	if mt.staged == nil {
+		return errReadOnlyTx
+	}
+	mt.stage(bucket, key, nil)
+	return nil
+}
+
+func (mt *memoryTx) Iterate(bucket string, prefix string, fn func(key string, value []byte) error) error {
+	return mt.each(bucket, func(k string) bool { return strings.HasPrefix(k, prefix) }, fn)
+}
+
+func (mt *memoryTx) Seek(bucket string, start string, fn func(key string, value []byte) error) error {
+	return mt.each(bucket, func(k string) bool { return k >= start }, fn)
+}
+
+// each calls fn in key order for the keys of bucket, committed or staged,
+// that match.
+func (mt *memoryTx) each(bucket string, match func(k string) bool, fn func(key string, value []byte) error) error {
+	seen := map[string]bool{}
+	var keys []string
+	for k := range mt.ms.buckets[bucket] {
+		if match(k) {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	for k := range mt.staged[bucket] {
+		if match(k) && !seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := mt.Get(bucket, k)
+		if v == nil {
+			continue
+		}
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	// registers the "sqlite3" driver; it needs cgo and reports so at
+	// open time in builds without it
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore keeps the buckets in a single key/value table of a database/sql
+// database, so several goserv instances can share watched state. The SQL
+// is written for SQLite.
+type sqlStore struct {
+	storeOps
+	db *sql.DB
+}
+
+// sqliteDSNOptions make concurrent writers from several instances wait
+// for each other instead of failing with "database is locked", and take
+// the write lock up front so a transaction never has to upgrade to it.
+const sqliteDSNOptions = "?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS goserv_kv (
+	bucket TEXT NOT NULL,
+	key    TEXT NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+)`
+
+func openSQLStore(driver string, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s store: %w", driver, err)
+	}
+	// mattn/go-sqlite3 reports that cgo is missing on first use only
+	_, err = db.Exec(sqlSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ss := &sqlStore{db: db}
+	ss.storeOps = storeOps{r: ss}
+	return ss, nil
+}
+
+func (ss *sqlStore) run(ctx context.Context, readOnly bool, fn func(tx StoreTx) error) error {
+	tx, err := ss.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return err
+	}
+	st := &sqlTx{ctx: ctx, tx: tx, readOnly: readOnly}
+	err = fn(st)
+	if err == nil {
+		err = st.err
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *sqlStore) View(ctx context.Context, fn func(tx StoreTx) error) error {
+	return ss.run(ctx, true, fn)
+}
+
+func (ss *sqlStore) Update(ctx context.Context, fn func(tx StoreTx) error) error {
+	return ss.run(ctx, false, fn)
+}
+
+func (ss *sqlStore) Close() error {
+	return ss.db.Close()
+}
+
+type sqlTx struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	readOnly bool
+	// err is the first failed Get, reported when the transaction ends
+	err error
+}
+
+func (st *sqlTx) Get(bucket string, key string) []byte {
+	var v []byte
+	err := st.tx.QueryRowContext(st.ctx, "SELECT value FROM goserv_kv WHERE bucket = ? AND key = ?", bucket, key).Scan(&v)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) && st.err == nil {
+			st.err = err
+		}
+		return nil
+	}
+	return v
+}
+
+func (st *sqlTx) Put(bucket string, key string, value []byte) error {
+	if st.readOnly {
+		return errReadOnlyTx
+	}
+	_, err := st.tx.ExecContext(st.ctx,
+		"INSERT INTO goserv_kv (bucket, key, value) VALUES (?, ?, ?) ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value",
+		bucket, key, value)
+	return err
+}
+
+func (st *sqlTx) Delete(bucket string, key string) error {
+	if st.readOnly {
+		return errReadOnlyTx
+	}
+	_, err := st.tx.ExecContext(st.ctx, "DELETE FROM goserv_kv WHERE bucket = ? AND key = ?", bucket, key)
+	return err
+}
+
+// Iterate reads all matching rows before calling fn, so fn may issue
+// further statements on the transaction.
+func (st *sqlTx) Iterate(bucket string, prefix string, fn func(key string, value []byte) error) error {
+	return st.each(bucket, prefix, prefix, fn)
+}
+
+// Seek reads all rows from start on before calling fn, like Iterate.
+func (st *sqlTx) Seek(bucket string, start string, fn func(key string, value []byte) error) error {
+	return st.each(bucket, start, "", fn)
+}
+
+func (st *sqlTx) each(bucket string, start string, prefix string, fn func(key string, value []byte) error) error {
+	rows, err := st.tx.QueryContext(st.ctx,
+		"SELECT key, value FROM goserv_kv WHERE bucket = ? AND key >= ? ORDER BY key", bucket, start)
+	if err != nil {
+		return err
+	}
+	type kv struct {
+		k string
+		v []byte
+	}
+	var res []kv
+	for rows.Next() {
+		var r kv
+		err = rows.Scan(&r.k, &r.v)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !strings.HasPrefix(r.k, prefix) {
+			break
+		}
+		res = append(res, r)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		err = fn(r.k, r.v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func storeBackends(t *testing.T) map[string]Store {
+	bs, err := openBoltStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bs.Close() })
+	ss, err := openSQLStore("sqlite3", filepath.Join(t.TempDir(), "store.sqlite")+sqliteDSNOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	return map[string]Store{
+		"memory": newMemoryStore(),
+		"bolt":   bs,
+		"sqlite": ss,
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if v, err := store.Get(ctx, "test", "missing"); err != nil || v != nil {
+				t.Fatalf("get missing = %q, %v", v, err)
+			}
+			for _, k := range []string{"b/2", "a", "b/1", "c", "b"} {
+				err := store.Put(ctx, "test", k, []byte("v-"+k))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if v, err := store.Get(ctx, "test", "b/1"); err != nil || string(v) != "v-b/1" {
+				t.Fatalf("get b/1 = %q, %v", v, err)
+			}
+			keys, err := store.List(ctx, "test", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b", "b/1", "b/2", "c"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("list = %v, want %v", keys, want)
+			}
+			keys, _ = store.List(ctx, "test", "b/")
+			if want := []string{"b/1", "b/2"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("list b/ = %v, want %v", keys, want)
+			}
+			var tail []string
+			err = store.View(ctx, func(tx StoreTx) error {
+				return tx.Seek("test", "b/", func(k string, v []byte) error {
+					tail = append(tail, k)
+					return nil
+				})
+			})
+			if want := []string{"b/1", "b/2", "c"}; err != nil || !reflect.DeepEqual(tail, want) {
+				t.Fatalf("seek b/ = %v, %v, want %v", tail, err, want)
+			}
+			err = store.Delete(ctx, "test", "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, _ = store.List(ctx, "test", "b")
+			if want := []string{"b/1", "b/2"}; !reflect.DeepEqual(keys, want) {
+				t.Fatalf("list after delete = %v, want %v", keys, want)
+			}
+			if keys, _ := store.List(ctx, "other", ""); len(keys) != 0 {
+				t.Fatalf("buckets not separate: %v", keys)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateRollback(t *testing.T) {
+	const rollbackBucket = "rollback"
+	ctx := context.Background()
+	errBoom := errors.New("boom")
+	for name, store := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			_ = store.Put(ctx, "test", "keep", []byte("1"))
+			err := store.Update(ctx, func(tx StoreTx) error {
+				_ = tx.Put(rollbackBucket, "new", []byte("x"))
+				_ = tx.Delete("test", "keep")
+				if v := tx.Get(rollbackBucket, "new"); string(v) != "x" {
+					t.Errorf("staged write not visible in its transaction: %q", v)
+				}
+				return errBoom
+			})
+			if !errors.Is(err, errBoom) {
+				t.Fatalf("update err = %v", err)
+			}
+			if v, _ := store.Get(ctx, "test", "keep"); string(v) != "1" {
+				t.Errorf("rolled back delete applied, keep = %q", v)
+			}
+			if v, _ := store.Get(ctx, rollbackBucket, "new"); v != nil {
+				t.Errorf("rolled back put applied, new = %q", v)
+			}
+			err = store.View(ctx, func(tx StoreTx) error {
+				return tx.Put("test", "keep", []byte("2"))
+			})
+			if err == nil {
+				t.Errorf("put in a read-only transaction succeeded")
+			}
+		})
+	}
+}
+
+func TestStoreCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, store := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			err := store.Put(ctx, "test", "k", []byte("v"))
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("put with cancelled context = %v", err)
+			}
+			if v, _ := store.Get(context.Background(), "test", "k"); v != nil {
+				t.Errorf("cancelled put was applied")
+			}
+		})
+	}
+}
+
+func TestBoltonOnMemoryStore(t *testing.T) {
+	bolton := NewBolton(newMemoryStore())
+	err := bolton.update("shows/a/e01.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, ok := bolton.getRecord("shows/a/e01.mkv"); !ok || !rec.Watched {
+		t.Fatalf("record = %+v, %v", rec, ok)
+	}
+	err = bolton.rename("shows/a", "shows/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bolton.getRecord("shows/b/e01.mkv"); !ok {
+		t.Errorf("record not renamed")
+	}
+	if _, err := bolton.boltDB(); err == nil {
+		t.Errorf("boltDB on a memory store succeeded")
+	}
+}
+
+func TestSQLStoreShared(t *testing.T) {
+	ctx := context.Background()
+	dsn := filepath.Join(t.TempDir(), "shared.sqlite") + sqliteDSNOptions
+	a, err := openSQLStore("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := openSQLStore("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// two instances on one database see each other's watched state
+	err = NewBolton(a).update("shows/a/e01.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, ok := NewBolton(b).getRecord("shows/a/e01.mkv"); !ok || !rec.Watched {
+		t.Fatalf("record = %+v, %v", rec, ok)
+	}
+	done := make(chan error)
+	for _, s := range []Store{a, b} {
+		go func(s Store) {
+			var err error
+			for i := 0; i < 20 && err == nil; i++ {
+				err = s.Update(ctx, func(tx StoreTx) error {
+					n := len(tx.Get("test", "counter"))
+					return tx.Put("test", "counter", make([]byte, n+1))
+				})
+			}
+			done <- err
+		}(s)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("concurrent update: %v", err)
+		}
+	}
+	if v, _ := a.Get(ctx, "test", "counter"); len(v) != 40 {
+		t.Errorf("counter = %d, want 40", len(v))
+	}
+}
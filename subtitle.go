@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// srtTiming matches an SRT cue timing line. Hours are optional and a dot is
+// accepted for the millisecond separator, both seen in the wild.
+var srtTiming = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{1,2}[,.]\d{1,3})\s*-->\s*((?:\d+:)?\d{1,2}:\d{1,2}[,.]\d{1,3})`)
+
+// vttTimestamp rewrites an SRT timestamp as hh:mm:ss.mmm.
+func vttTimestamp(ts string) string {
+	ts = strings.Replace(ts, ",", ".", 1)
+	clock, ms, _ := strings.Cut(ts, ".")
+	for len(ms) < 3 {
+		ms += "0"
+	}
+	parts := strings.Split(clock, ":")
+	for len(parts) < 3 {
+		parts = append([]string{"0"}, parts...)
+	}
+	for i, p := range parts {
+		if len(p) < 2 {
+			parts[i] = "0" + p
+		}
+	}
+	return strings.Join(parts, ":") + "." + ms
+}
+
+// convertSRT writes the SRT subtitles read from r to w as WebVTT. Cue
+// numbers are kept as cue identifiers, positioning hints after the timing
+// are dropped and "-->" inside cue text is escaped as WebVTT requires.
+// Blocks without a timing line are skipped.
+func convertSRT(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	var block []string
+	writeCue := func() {
+		defer func() { block = block[:0] }()
+		timing := -1
+		for i, l := range block {
+			if i > 1 {
+				break
+			}
+			if srtTiming.MatchString(l) {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			return
+		}
+		m := srtTiming.FindStringSubmatch(block[timing])
+		bw.WriteString("\n")
+		if timing == 1 {
+			bw.WriteString(strings.TrimSpace(block[0]) + "\n")
+		}
+		bw.WriteString(vttTimestamp(m[1]) + " --> " + vttTimestamp(m[2]) + "\n")
+		for _, l := range block[timing+1:] {
+			bw.WriteString(strings.ReplaceAll(l, "-->", "--&gt;") + "\n")
+		}
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	first := true
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		if strings.TrimSpace(line) == "" {
+			writeCue()
+			continue
+		}
+		block = append(block, line)
+	}
+	err := sc.Err()
+	if err != nil {
+		return err
+	}
+	writeCue()
+	return bw.Flush()
+}
+
+// SubtitleTrack is a subtitle file found next to a video.
+type SubtitleTrack struct {
+	Label string `json:"label"`
+	Lang  string `json:"lang,omitempty"`
+	Src   string `json:"src"`
+}
+
+var subtitleExts = map[string]bool{".srt": true, ".vtt": true}
+
+// findSubtitles discovers the subtitles of the video key by naming
+// convention: movie.mkv pairs with movie.srt, movie.en.srt,
+// movie.eng.forced.vtt and so on in the same directory.
+func findSubtitles(key string) []SubtitleTrack {
+	dir := path.Dir(key)
+	stem := strings.TrimSuffix(path.Base(key), path.Ext(key))
+	files, err := os.ReadDir(filepath.Join(goServDir, filepath.FromSlash(dir)))
+	if err != nil {
+		return nil
+	}
+	var tracks []SubtitleTrack
+	for _, f := range files {
+		name := f.Name()
+		ext := strings.ToLower(path.Ext(name))
+		if f.IsDir() || !subtitleExts[ext] || goIgnoreFiles.Contains(name) {
+			continue
+		}
+		base := strings.TrimSuffix(name, path.Ext(name))
+		if base != stem && !strings.HasPrefix(base, stem+".") {
+			continue
+		}
+		tags := strings.TrimPrefix(strings.TrimPrefix(base, stem), ".")
+		track := SubtitleTrack{Label: tags, Src: "/_/subs?path=" + url.QueryEscape(getKey(dir, name))}
+		if tags == "" {
+			track.Label = "default"
+		}
+		lang, _, _ := strings.Cut(tags, ".")
+		if len(lang) == 2 || len(lang) == 3 {
+			track.Lang = strings.ToLower(lang)
+		}
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Label < tracks[j].Label
+	})
+	return tracks
+}
+
+// handleSubtitles serves the subtitle file ?path= as WebVTT, converting
+// SRT on the fly.
+func handleSubtitles(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "subtitles")
+	key := cleanKey(r.FormValue("path"))
+	ext := strings.ToLower(path.Ext(key))
+	if !subtitleExts[ext] || isServerDir(key) || goIgnoreFiles.Contains(path.Base(key)) {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(goServDir, filepath.FromSlash(key)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if ext == ".vtt" {
+		_, _ = w.Write(data)
+		return
+	}
+	var buf bytes.Buffer
+	err = convertSRT(&buf, bytes.NewReader(data))
+	if err != nil {
+		slog.Warn("convert subtitles", "path", key, "err", err)
+		http.Error(w, fmt.Sprintf("Cannot convert %s", path.Base(key)), http.StatusUnprocessableEntity)
+		return
+	}
+	_, _ = buf.WriteTo(w)
+}
+
+// handleSubtitlesAPI lists the subtitle tracks of the video ?path=.
+func handleSubtitlesAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "api")
+	key := cleanKey(r.FormValue("path"))
+	if getMediaKind(key) != "video" || isServerDir(key) {
+		http.NotFound(w, r)
+		return
+	}
+	tracks := findSubtitles(key)
+	if tracks == nil {
+		tracks = []SubtitleTrack{}
+	}
+	writeJSON(w, http.StatusOK, tracks)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertSRT(t *testing.T) {
+	var tests = []struct {
+		name string
+		srt  string
+		want string
+	}{
+		{
+			"basic",
+			"1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nTwo\nlines\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500\nHello\n\n2\n00:00:03.000 --> 00:00:04.000\nTwo\nlines\n",
+		},
+		{
+			"crlf and bom",
+			"\ufeff1\r\n00:00:01,000 --> 00:00:02,000\r\n<i>Hi</i>\r\n\r\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\n<i>Hi</i>\n",
+		},
+		{
+			"sloppy timestamps",
+			"7\n0:01:02,5 --> 0:01:03.25 X1:100 X2:200\ntext\n",
+			"WEBVTT\n\n7\n00:01:02.500 --> 00:01:03.250\ntext\n",
+		},
+		{
+			"no numbers, extra blank lines",
+			"\n\n00:00:01,000 --> 00:00:02,000\na\n\n\n\n00:00:03,000 --> 00:00:04,000\nb",
+			"WEBVTT\n\n00:00:01.000 --> 00:00:02.000\na\n\n00:00:03.000 --> 00:00:04.000\nb\n",
+		},
+		{
+			"arrow in text",
+			"1\n00:00:01,000 --> 00:00:02,000\nA --> B\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nA --&gt; B\n",
+		},
+		{
+			"garbage block skipped",
+			"not a cue\nat all\n\n1\n00:00:01,000 --> 00:00:02,000\nok\n",
+			"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nok\n",
+		},
+		{"empty", "", "WEBVTT\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := convertSRT(&buf, strings.NewReader(tt.srt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFindSubtitles(t *testing.T) {
+	setupServedDir(t, "m/movie.mkv", "m/movie.srt", "m/movie.en.srt", "m/movie.fin.forced.vtt",
+		"m/movie2.srt", "m/other.en.srt", "m/movie.txt")
+	got := findSubtitles("m/movie.mkv")
+	want := []SubtitleTrack{
+		{Label: "default", Src: "/_/subs?path=m%2Fmovie.srt"},
+		{Label: "en", Lang: "en", Src: "/_/subs?path=m%2Fmovie.en.srt"},
+		{Label: "fin.forced", Lang: "fin", Src: "/_/subs?path=m%2Fmovie.fin.forced.vtt"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestHandleSubtitles(t *testing.T) {
+	dir := setupServedDir(t, "s/a.mkv", trashDir+"/1/b.srt")
+	err := os.WriteFile(filepath.Join(dir, "s", "a.srt"), []byte("1\n00:00:01,000 --> 00:00:02,000\nhi\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleSubtitles(w, httptest.NewRequest("GET", "/_/subs?path=s%2Fa.srt", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/vtt; charset=utf-8" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Body.String(), "WEBVTT\n\n1\n00:00:01.000") {
+		t.Errorf("not converted: %q", w.Body.String())
+	}
+	for _, p := range []string{"s/a.mkv", "s/missing.srt", trashDir + "/1/b.srt"} {
+		w := httptest.NewRecorder()
+		handleSubtitles(w, httptest.NewRequest("GET", "/_/subs?path="+p, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d", p, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handlePlayer(w, httptest.NewRequest("GET", "/_/play?path=s%2Fa.mkv", nil))
+	if !strings.Contains(w.Body.String(), `<track kind="subtitles" src="/_/subs?path=s%2Fa.srt" label="default">`) {
+		t.Errorf("player page lacks the subtitle track")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// thumbSize is the longest edge of a thumbnail in pixels
+	thumbSize = 240
+	// thumbMaxPixels refuses sources that would take too much memory to
+	// decode, such as decompression bombs
+	thumbMaxPixels = 64 << 20
+	// thumbCacheDir is the default thumbnail cache below goServDir,
+	// hidden from listings like the trash
+	thumbCacheDir = ".goserv-thumbs"
+)
+
+// thumbDecoders are the formats thumbnails are made of, by extension. Video
+// has no decoder in the standard library and is listed without a preview.
+var thumbDecoders = map[string]func(io.Reader) (image.Image, error){
+	".jpg":  jpeg.Decode,
+	".jpeg": jpeg.Decode,
+	".png":  png.Decode,
+	".gif":  gif.Decode,
+}
+
+func hasThumbnail(name string) bool {
+	_, ok := thumbDecoders[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// getThumbHref returns the thumbnail URL of the entry key, or "" when its
+// format is not supported.
+func getThumbHref(key string) string {
+	if !hasThumbnail(key) {
+		return ""
+	}
+	return "/_/thumb?path=" + url.QueryEscape(key)
+}
+
+// Thumbnailer renders thumbnails lazily on first request and keeps them as
+// JPEG files in dir, named after the source path, size and mtime so that a
+// changed file gets a fresh preview. At most workers thumbnails are decoded
+// at a time; concurrent requests for the same one share the work.
+type Thumbnailer struct {
+	dir  string
+	sem  chan struct{}
+	mu   sync.Mutex
+	busy map[string]*thumbJob
+}
+
+type thumbJob struct {
+	done chan struct{}
+	err  error
+}
+
+func NewThumbnailer(dir string, workers int) *Thumbnailer {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Thumbnailer{
+		dir:  dir,
+		sem:  make(chan struct{}, workers),
+		busy: map[string]*thumbJob{},
+	}
+}
+
+func (th *Thumbnailer) cacheName(key string, fi os.FileInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", key, fi.Size(), fi.ModTime().UnixNano())))
+	return filepath.Join(th.dir, hex.EncodeToString(sum[:16])+".jpg")
+}
+
+// get returns the path of the cached thumbnail of src, rendering it first
+// when needed.
+func (th *Thumbnailer) get(key string, src string) (string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	dst := th.cacheName(key, fi)
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+	th.mu.Lock()
+	job, ok := th.busy[dst]
+	if !ok {
+		job = &thumbJob{done: make(chan struct{})}
+		th.busy[dst] = job
+	}
+	th.mu.Unlock()
+	if ok {
+		<-job.done
+		return dst, job.err
+	}
+	th.sem <- struct{}{}
+	job.err = th.render(src, dst)
+	<-th.sem
+	th.mu.Lock()
+	delete(th.busy, dst)
+	th.mu.Unlock()
+	close(job.done)
+	return dst, job.err
+}
+
+func (th *Thumbnailer) render(src string, dst string) error {
+	decode, ok := thumbDecoders[strings.ToLower(filepath.Ext(src))]
+	if !ok {
+		return fmt.Errorf("no thumbnails for %s", filepath.Ext(src))
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > thumbMaxPixels {
+		return fmt.Errorf("%dx%d image too large", cfg.Width, cfg.Height)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	img, err := decode(f)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(th.dir, 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(th.dir, "thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = jpeg.Encode(tmp, scaleImage(img, thumbSize), &jpeg.Options{Quality: 80})
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// scaleImage shrinks img so its longest edge is at most size, averaging
+// every source pixel into the destination pixel it falls on. Smaller images
+// are only flattened onto white.
+func scaleImage(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(1, h*size/w)
+		} else {
+			tw, th = max(1, w*size/h), size
+		}
+	}
+	type acc struct{ r, g, b, a, n uint64 }
+	sums := make([]acc, tw*th)
+	for y := 0; y < h; y++ {
+		ty := y * th / h
+		for x := 0; x < w; x++ {
+			tx := x * tw / w
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			s := &sums[ty*tw+tx]
+			s.r += uint64(r)
+			s.g += uint64(g)
+			s.b += uint64(bl)
+			s.a += uint64(a)
+			s.n++
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for i, s := range sums {
+		if s.n == 0 {
+			continue
+		}
+		// colors are premultiplied, so adding the uncovered part gives the
+		// pixel composited over white
+		bg := 0xffff - s.a/s.n
+		dst.SetRGBA64(i%tw, i/tw, color.RGBA64{
+			R: uint16(s.r/s.n + bg),
+			G: uint16(s.g/s.n + bg),
+			B: uint16(s.b/s.n + bg),
+			A: 0xffff,
+		})
+	}
+	return dst
+}
+
+// thumbnailer is built by startThumbnails before the server accepts
+// requests, so handlers only ever read it.
+var thumbnailer *Thumbnailer
+
+// startThumbnails builds the thumbnailer for -thumb-dir, or for the
+// default cache below goServDir, which it hides from listings.
+func startThumbnails() {
+	dir := goServThumbDir
+	if dir == "" {
+		dir = filepath.Join(goServDir, thumbCacheDir)
+	}
+	thumbnailer = NewThumbnailer(dir, goServThumbWorkers)
+	hideThumbCache()
+}
+
+// hideThumbCache keeps the default thumbnail cache out of listings, so its
+// images are neither shown nor thumbnailed themselves.
+func hideThumbCache() {
+	if goServThumbDir == "" && !goIgnoreFiles.Contains(thumbCacheDir) {
+		goIgnoreFiles = append(goIgnoreFiles, thumbCacheDir)
+	}
+}
+
+// handleThumb serves the thumbnail of ?path=, rendering it on first use.
+func handleThumb(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "thumb")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	key := cleanKey(r.FormValue("path"))
+	if !hasThumbnail(key) || isServerDir(key) || goIgnoreFiles.Contains(filepath.Base(key)) {
+		http.NotFound(w, r)
+		return
+	}
+	name, err := thumbnailer.get(key, filepath.Join(goServDir, filepath.FromSlash(key)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Warn("thumbnail", "path", key, "err", err)
+		http.Error(w, "Cannot render thumbnail", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, name)
+}
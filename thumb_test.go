@@ -0,0 +1,152 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestScaleImage(t *testing.T) {
+	var tests = []struct {
+		name  string
+		w, h  int
+		wantW int
+		wantH int
+	}{
+		{"landscape", 1000, 500, 240, 120},
+		{"portrait", 300, 900, 80, 240},
+		{"small", 100, 50, 100, 50},
+		{"sliver", 5000, 2, 240, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, tt.w, tt.h))
+			got := scaleImage(img, 240).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Fatalf("scaled to %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestScaleImageFlattensOnWhite(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 4; i++ {
+		img.Set(i, 0, color.NRGBA{255, 0, 0, 255})
+	}
+	got := scaleImage(img, 2)
+	if c := got.RGBAAt(0, 1); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("transparent area = %v, want white", c)
+	}
+	if c := got.RGBAAt(0, 0); c.R != 255 || c.G < 127 || c.G > 128 || c.B != c.G {
+		t.Errorf("half red area = %v", c)
+	}
+}
+
+func writePNG(t *testing.T, name string, w, h int) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleThumb(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "photo.png"), 800, 600)
+	err := os.WriteFile(filepath.Join(dir, "broken.jpg"), []byte("not a jpeg"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir := goServDir
+	goServDir = dir
+	cache := t.TempDir()
+	savedThumbnailer := thumbnailer
+	thumbnailer = NewThumbnailer(cache, 2)
+	defer func() {
+		goServDir = savedDir
+		thumbnailer = savedThumbnailer
+	}()
+
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleThumb(w, httptest.NewRequest("GET", getThumbHref(p), nil))
+		return w
+	}
+	w := get("photo.png")
+	if w.Code != http.StatusOK {
+		t.Fatalf("thumb returned %d", w.Code)
+	}
+	cfg, err := jpeg.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 240 || cfg.Height != 180 {
+		t.Errorf("thumb is %dx%d", cfg.Width, cfg.Height)
+	}
+	cached, _ := filepath.Glob(filepath.Join(cache, "*.jpg"))
+	if len(cached) != 1 {
+		t.Fatalf("cache holds %d thumbnails, want 1", len(cached))
+	}
+	if w := get("photo.png"); w.Code != http.StatusOK {
+		t.Errorf("cached thumb returned %d", w.Code)
+	}
+	if w := get("broken.jpg"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("broken image returned %d", w.Code)
+	}
+	if w := get("missing.png"); w.Code != http.StatusNotFound {
+		t.Errorf("missing image returned %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleThumb(w, httptest.NewRequest("GET", "/_/thumb?path=movie.mkv", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("video returned %d", w.Code)
+	}
+	err = os.Mkdir(filepath.Join(dir, thumbCacheDir), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePNG(t, filepath.Join(dir, thumbCacheDir, "cached.png"), 10, 10)
+	if w := get(thumbCacheDir + "/cached.png"); w.Code != http.StatusNotFound {
+		t.Errorf("thumbnail cache returned %d", w.Code)
+	}
+}
+
+func TestThumbnailerConcurrentRequests(t *testing.T) {
+	dir := t.TempDir()
+	for _, n := range []string{"a", "b", "c", "d", "e", "f"} {
+		writePNG(t, filepath.Join(dir, n+".png"), 400, 400)
+	}
+	th := NewThumbnailer(t.TempDir(), 2)
+	var wg sync.WaitGroup
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "a", "a"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := th.get(n+".png", filepath.Join(dir, n+".png"))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(th.busy) != 0 || len(th.sem) != 0 {
+		t.Errorf("thumbnailer left %d jobs and %d workers busy", len(th.busy), len(th.sem))
+	}
+	cached, _ := filepath.Glob(filepath.Join(th.dir, "*.jpg"))
+	if len(cached) != 6 {
+		t.Errorf("cache holds %d thumbnails, want 6", len(cached))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessTokenParam is the query parameter carrying an access token.
+const accessTokenParam = "t"
+
+var (
+	errTokenInvalid = errors.New("invalid access token")
+	errTokenExpired = errors.New("access token expired")
+	errTokenScope   = errors.New("access token not valid for this path")
+)
+
+// AccessClaims is what an access token grants: requests for Scope or
+// anything below it, on behalf of User, until Expires.
+type AccessClaims struct {
+	User    string `json:"u,omitempty"`
+	Scope   string `json:"s"`
+	Expires int64  `json:"e"`
+}
+
+var (
+	tokenSecretOnce sync.Once
+	tokenSecret     []byte
+)
+
+// getTokenSecret returns the HMAC key of access tokens: -token-secret, or a
+// random key so that tokens die with the process.
+func getTokenSecret() []byte {
+	tokenSecretOnce.Do(func() {
+		if goServTokenSecret != "" {
+			tokenSecret = []byte(goServTokenSecret)
+			return
+		}
+		tokenSecret = make([]byte, 32)
+		_, err := rand.Read(tokenSecret)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return tokenSecret
+}
+
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, getTokenSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mintAccessToken returns a token for scope valid for ttl.
+func mintAccessToken(user string, scope string, ttl time.Duration) string {
+	v, err := json.Marshal(AccessClaims{User: user, Scope: scope, Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		// AccessClaims has no types json cannot encode
+		panic(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(v)
+	return payload + "." + signToken(payload)
+}
+
+// inScope reports whether key is scope or lies below it.
+func inScope(key string, scope string) bool {
+	return scope == "." || key == scope || strings.HasPrefix(key, scope+"/")
+}
+
+// verifyAccessToken checks the signature and expiry of token and that it
+// covers key.
+func verifyAccessToken(token string, key string, now time.Time) (AccessClaims, error) {
+	var claims AccessClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signToken(payload))) {
+		return claims, errTokenInvalid
+	}
+	v, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+	err = json.Unmarshal(v, &claims)
+	if err != nil {
+		return claims, errTokenInvalid
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, errTokenExpired
+	}
+	if !inScope(key, claims.Scope) {
+		return claims, errTokenScope
+	}
+	return claims, nil
+}
+
+type tokenUserKey struct{}
+
+// getTokenUser returns the user of the access token checkAccessToken
+// verified for r, or "".
+func getTokenUser(r *http.Request) string {
+	user, _ := r.Context().Value(tokenUserKey{}).(string)
+	return user
+}
+
+// checkAccessToken rejects requests carrying an invalid, expired or out of
+// scope token and attributes the others to the user the token was minted
+// for.
+func checkAccessToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get(accessTokenParam)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := verifyAccessToken(token, path.Clean(r.URL.Path), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenUserKey{}, claims.User)))
+	})
+}
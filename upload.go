@@ -0,0 +1,738 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// uploadStagingDir holds partial uploads below goServDir, so that
+	// completed files are moved into place with an atomic rename
+	uploadStagingDir = ".goserv-uploads"
+	tusVersion       = "1.0.0"
+	tusPrefix        = apiPrefix + "tus/"
+	// uploadStaleAfter is how long an unfinished resumable upload is kept
+	uploadStaleAfter = 7 * 24 * time.Hour
+)
+
+var (
+	errUploadDisabled = errors.New("uploads are not enabled for this directory")
+	errUploadName     = errors.New("invalid file name")
+	errUploadExists   = errors.New("file already exists")
+	errUploadTooLarge = errors.New("file exceeds the upload size limit")
+	errUploadQuota    = errors.New("upload quota exceeded")
+	errUploadBusy     = errors.New("upload is being written by another request")
+)
+
+// sanitizeFilename reduces a client supplied name to a single safe path
+// element: no directories, no control characters, no leading dots and at
+// most 255 bytes.
+func sanitizeFilename(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == 0xfffd {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(strings.TrimLeft(name, ". "))
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || goIgnoreFiles.Contains(name) {
+		return "", errUploadName
+	}
+	return name, nil
+}
+
+// isUploadStaging reports whether key lies in the staging directory, which
+// is never served.
+func isUploadStaging(key string) bool {
+	return key == uploadStagingDir || strings.HasPrefix(key, uploadStagingDir+"/")
+}
+
+// canUpload reports whether the listing of key offers an upload form.
+func canUpload(key string) bool {
+	_, _, err := resolveUploadDir(key)
+	return err == nil
+}
+
+// getUploadRoot returns the upload enabled directory, from -upload, that
+// contains the directory key.
+func getUploadRoot(key string) (string, bool) {
+	for _, root := range goServUploadDirs {
+		root = cleanKey(root)
+		if inScope(key, root) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// errOutsideRoot is returned for paths that resolve outside goServDir.
+var errOutsideRoot = errors.New("path leaves the served directory")
+
+// resolveServedDir resolves the directory key through symlinks. It returns
+// the resolved path and its key relative to goServDir, or errOutsideRoot
+// when a symlink leads out of goServDir.
+func resolveServedDir(key string) (string, string, error) {
+	base, err := filepath.EvalSymlinks(goServDir)
+	if err != nil {
+		return "", "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(goServDir, filepath.FromSlash(key)))
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", errOutsideRoot
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if !fi.IsDir() {
+		return "", "", fmt.Errorf("%s is not a directory", key)
+	}
+	return dir, filepath.ToSlash(rel), nil
+}
+
+// resolveUploadDir checks that uploads into the directory key are allowed
+// and that it really lies in an upload directory, symlinks resolved.
+func resolveUploadDir(key string) (string, string, error) {
+	root, ok := getUploadRoot(key)
+	if !ok || isUploadStaging(key) {
+		return "", "", errUploadDisabled
+	}
+	dir, rel, err := resolveServedDir(key)
+	if errors.Is(err, errOutsideRoot) {
+		return "", "", errUploadDisabled
+	}
+	if err != nil {
+		return "", "", err
+	}
+	// a symlink must not lead out of the upload enabled directories either
+	if _, ok := getUploadRoot(rel); !ok || isUploadStaging(rel) {
+		return "", "", errUploadDisabled
+	}
+	return root, dir, nil
+}
+
+// getUploadUsage sums the size of the files below the upload root.
+func getUploadUsage(root string) (int64, error) {
+	return getTreeSize(filepath.Join(goServDir, filepath.FromSlash(root)))
+}
+
+// getTreeSize sums the size of the file name or the files below it,
+// leaving out upload staging.
+func getTreeSize(name string) (int64, error) {
+	var n int64
+	err := filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == uploadStagingDir {
+			return fs.SkipDir
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err == nil {
+				n += fi.Size()
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// getReservedUploads sums the Upload-Length of the resumable uploads in
+// progress below root, except the upload exclude. Their bytes are still in
+// staging, but count against the quota from creation on.
+func getReservedUploads(root string, exclude string) (int64, error) {
+	var n int64
+	err := GetBoltInstance().store.Iterate(context.Background(), uploadBucket, "", func(k string, v []byte) error {
+		var u TusUpload
+		if k != exclude && json.Unmarshal(v, &u) == nil && inScope(u.Dir, root) {
+			n += u.Length
+		}
+		return nil
+	})
+	return n, err
+}
+
+// uploadQuotaMu makes checking the quota and committing the bytes it
+// allowed one step, so that concurrent uploads cannot each pass the check
+// and together exceed it.
+var uploadQuotaMu sync.Mutex
+
+// checkUploadSize enforces -upload-max-size and -upload-quota for size more
+// bytes below root, besides those reserved by resumable uploads other than
+// exclude. Callers hold uploadQuotaMu until the bytes are committed.
+func checkUploadSize(root string, size int64, exclude string) error {
+	if goServUploadMaxSize > 0 && size > goServUploadMaxSize {
+		return errUploadTooLarge
+	}
+	return checkUploadQuota(root, size, exclude)
+}
+
+// checkUploadQuota is the -upload-quota part of checkUploadSize.
+func checkUploadQuota(root string, size int64, exclude string) error {
+	if goServUploadQuota <= 0 {
+		return nil
+	}
+	used, err := getUploadUsage(root)
+	if err != nil {
+		return err
+	}
+	reserved, err := getReservedUploads(root, exclude)
+	if err != nil {
+		return err
+	}
+	if used+reserved+size > goServUploadQuota {
+		return errUploadQuota
+	}
+	return nil
+}
+
+func getStagingDir() (string, error) {
+	dir := filepath.Join(goServDir, uploadStagingDir)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// finishUpload moves a completed staging file to dir/name without
+// replacing an existing file.
+func finishUpload(tmp string, dir string, name string) error {
+	dst := filepath.Join(dir, name)
+	// a hard link fails when dst exists, unlike rename
+	err := os.Link(tmp, dst)
+	if errors.Is(err, fs.ErrExist) {
+		return errUploadExists
+	}
+	if err != nil {
+		if _, serr := os.Lstat(dst); serr == nil {
+			return errUploadExists
+		}
+		err = os.Rename(tmp, dst)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+	return os.Remove(tmp)
+}
+
+func uploadStatus(err error) int {
+	switch {
+	case errors.Is(err, errUploadDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, errUploadName):
+		return http.StatusBadRequest
+	case errors.Is(err, errUploadExists), errors.Is(err, errUploadBusy):
+		return http.StatusConflict
+	case errors.Is(err, errUploadTooLarge), errors.Is(err, errUploadQuota):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func uploadError(w http.ResponseWriter, key string, err error) {
+	status := uploadStatus(err)
+	if status == http.StatusInternalServerError {
+		slog.Error("upload", "path", key, "err", err)
+		http.Error(w, "Internal server error", status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleUploadAPI accepts multipart/form-data uploads of one or more "file"
+// parts into the directory ?path=.
+// deadlineReader gives every read of a request body the ReadTimeout of
+// the server afresh. That timeout otherwise covers the whole request, and
+// an upload on a slow link takes far longer.
+type deadlineReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (dr *deadlineReader) Read(b []byte) (int, error) {
+	// not every writer supports deadlines; without one there is nothing to
+	// extend
+	_ = dr.rc.SetReadDeadline(time.Now().Add(dr.timeout))
+	return dr.ReadCloser.Read(b)
+}
+
+// extendReadDeadline makes the body of r a deadlineReader when the server
+// has a ReadTimeout.
+func extendReadDeadline(w http.ResponseWriter, r *http.Request) {
+	srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok || srv.ReadTimeout <= 0 {
+		return
+	}
+	r.Body = &deadlineReader{ReadCloser: r.Body, rc: http.NewResponseController(w), timeout: srv.ReadTimeout}
+}
+
+func handleUploadAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "upload")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	// the token must come in the header: falling back to the csrf form
+	// field would buffer the whole multipart body
+	if r.Header.Get("X-CSRF-Token") == "" || !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token, echo the "+csrfCookieName+" cookie in X-CSRF-Token", http.StatusForbidden)
+		return
+	}
+	key := cleanKey(r.URL.Query().Get("path"))
+	root, dir, err := resolveUploadDir(key)
+	if err != nil {
+		uploadError(w, key, err)
+		return
+	}
+	extendReadDeadline(w, r)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	staging, err := getStagingDir()
+	if err != nil {
+		uploadError(w, key, err)
+		return
+	}
+	var saved []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		name, err := sanitizeFilename(part.FileName())
+		if err == nil {
+			err = saveUploadPart(part, root, staging, dir, name)
+		}
+		if err != nil {
+			uploadError(w, getKey(key, part.FileName()), err)
+			return
+		}
+		saved = append(saved, getKey(key, name))
+		dirsChanged(getKey(key, name))
+		slog.Info("uploaded", "path", getKey(key, name), "user", getRequestUser(r))
+		err = recordAudit(r, "upload", getKey(key, name), "")
+		if err != nil {
+			slog.Error("audit", "path", getKey(key, name), "err", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"uploaded": saved})
+}
+
+func saveUploadPart(part io.Reader, root string, staging string, dir string, name string) error {
+	tmp, err := os.CreateTemp(staging, "multipart-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	limit := goServUploadMaxSize
+	if limit <= 0 {
+		limit = 1<<63 - 2
+	}
+	n, err := io.Copy(tmp, io.LimitReader(part, limit+1))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return errUploadTooLarge
+	}
+	uploadQuotaMu.Lock()
+	defer uploadQuotaMu.Unlock()
+	err = checkUploadSize(root, n, "")
+	if err != nil {
+		return err
+	}
+	return finishUpload(tmp.Name(), dir, name)
+}
+
+// TusUpload is a resumable upload in progress, kept in the uploads bucket.
+// The received bytes are the staging file, so its size is the offset.
+type TusUpload struct {
+	ID      string    `json:"id"`
+	Dir     string    `json:"dir"`
+	Name    string    `json:"name"`
+	Length  int64     `json:"length"`
+	User    string    `json:"user,omitempty"`
+	Created time.Time `json:"created"`
+	// Updated is when the last PATCH appended bytes
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+func (u TusUpload) stagingName() string {
+	return filepath.Join(goServDir, uploadStagingDir, "tus-"+u.ID)
+}
+
+func getTusUpload(id string) (TusUpload, error) {
+	var u TusUpload
+	v, err := GetBoltInstance().store.Get(context.Background(), uploadBucket, id)
+	if err != nil {
+		return u, err
+	}
+	if v == nil {
+		return u, fs.ErrNotExist
+	}
+	err = json.Unmarshal(v, &u)
+	return u, err
+}
+
+func putTusUpload(u TusUpload) error {
+	v, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return GetBoltInstance().store.Put(context.Background(), uploadBucket, u.ID, v)
+}
+
+func deleteTusUpload(u TusUpload) error {
+	err := os.Remove(u.stagingName())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return GetBoltInstance().store.Delete(context.Background(), uploadBucket, u.ID)
+}
+
+// tusBusy holds the IDs of the uploads a request is writing to, so that
+// concurrent PATCHes cannot interleave their bytes in the staging file.
+var tusBusy = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+func lockTusUpload(id string) bool {
+	tusBusy.Lock()
+	defer tusBusy.Unlock()
+	if tusBusy.ids[id] {
+		return false
+	}
+	tusBusy.ids[id] = true
+	return true
+}
+
+func unlockTusUpload(id string) {
+	tusBusy.Lock()
+	delete(tusBusy.ids, id)
+	tusBusy.Unlock()
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs.
+func parseTusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			continue
+		}
+		meta[k] = string(b)
+	}
+	return meta
+}
+
+// handleTus implements the core tus 1.0.0 protocol with the creation and
+// termination extensions under tusPrefix. The target directory and name
+// come from the "path" and "filename" metadata. Like the upload form,
+// every request but HEAD must echo the goserv_csrf cookie in the
+// X-CSRF-Token header, so scripted clients first fetch a listing to
+// obtain the cookie.
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "upload")
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		if goServUploadMaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(goServUploadMaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	if r.Method != http.MethodHead && !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token, echo the "+csrfCookieName+" cookie in X-CSRF-Token", http.StatusForbidden)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, tusPrefix)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUpload(w, r)
+		return
+	}
+	u, err := getTusUpload(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPatch || r.Method == http.MethodDelete {
+		if !lockTusUpload(u.ID) {
+			uploadError(w, u.Dir, errUploadBusy)
+			return
+		}
+		defer unlockTusUpload(u.ID)
+	}
+	switch r.Method {
+	case http.MethodHead:
+		fi, err := os.Stat(u.stagingName())
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		patchTusUpload(w, r, u)
+	case http.MethodDelete:
+		err = deleteTusUpload(u)
+		if err != nil {
+			uploadError(w, u.Dir, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+	}
+}
+
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	key := cleanKey(meta["path"])
+	root, _, err := resolveUploadDir(key)
+	if err == nil {
+		meta["filename"], err = sanitizeFilename(meta["filename"])
+	}
+	if err == nil {
+		if _, serr := os.Lstat(filepath.Join(goServDir, filepath.FromSlash(key), meta["filename"])); serr == nil {
+			err = errUploadExists
+		}
+	}
+	if err != nil {
+		uploadError(w, key, err)
+		return
+	}
+	u := TusUpload{ID: randomHex(16), Dir: key, Name: meta["filename"], Length: length, User: getRequestUser(r), Created: time.Now()}
+	_, err = getStagingDir()
+	if err == nil {
+		err = os.WriteFile(u.stagingName(), nil, 0600)
+	}
+	if err == nil {
+		// storing the upload reserves its length against the quota
+		uploadQuotaMu.Lock()
+		err = checkUploadSize(root, length, "")
+		if err == nil {
+			err = putTusUpload(u)
+		}
+		uploadQuotaMu.Unlock()
+		if err != nil {
+			os.Remove(u.stagingName())
+		}
+	}
+	if err != nil {
+		uploadError(w, key, err)
+		return
+	}
+	w.Header().Set("Location", tusPrefix+u.ID)
+	if length == 0 {
+		err = completeTusUpload(r, u)
+		if err != nil {
+			uploadError(w, key, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func patchTusUpload(w http.ResponseWriter, r *http.Request, u TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Expected application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	f, err := os.OpenFile(u.stagingName(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		uploadError(w, u.Dir, err)
+		return
+	}
+	if fi.Size() != offset {
+		f.Close()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+	extendReadDeadline(w, r)
+	n, err := io.Copy(f, io.LimitReader(r.Body, u.Length-offset))
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if n > 0 && offset < u.Length {
+		u.Updated = time.Now()
+		perr := putTusUpload(u)
+		if perr != nil {
+			slog.Warn("tus patch", "id", u.ID, "err", perr)
+		}
+	}
+	if err != nil {
+		// the client resumes from the offset it gets from HEAD
+		slog.Warn("tus patch", "id", u.ID, "err", err)
+		http.Error(w, "Incomplete chunk", http.StatusBadRequest)
+		return
+	}
+	if offset == u.Length {
+		err = completeTusUpload(r, u)
+		if err != nil {
+			uploadError(w, u.Dir, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func completeTusUpload(r *http.Request, u TusUpload) error {
+	root, dir, err := resolveUploadDir(u.Dir)
+	if err != nil {
+		return err
+	}
+	// the quota may have shrunk, or other files arrived, since creation
+	uploadQuotaMu.Lock()
+	err = checkUploadSize(root, u.Length, u.ID)
+	if err == nil {
+		err = finishUpload(u.stagingName(), dir, u.Name)
+	}
+	uploadQuotaMu.Unlock()
+	if err != nil {
+		return err
+	}
+	dirsChanged(getKey(u.Dir, u.Name))
+	slog.Info("uploaded", "path", getKey(u.Dir, u.Name), "user", u.User)
+	err = recordAudit(r, "upload", getKey(u.Dir, u.Name), "")
+	if err != nil {
+		slog.Error("audit", "path", getKey(u.Dir, u.Name), "err", err)
+	}
+	return GetBoltInstance().store.Delete(context.Background(), uploadBucket, u.ID)
+}
+
+// pruneStaleUploads drops resumable uploads that received no bytes for
+// longer than uploadStaleAfter.
+func pruneStaleUploads(now time.Time) error {
+	var stale []TusUpload
+	err := GetBoltInstance().store.Iterate(context.Background(), uploadBucket, "", func(k string, v []byte) error {
+		var u TusUpload
+		if json.Unmarshal(v, &u) != nil {
+			return nil
+		}
+		last := u.Updated
+		if last.IsZero() {
+			last = u.Created
+		}
+		if now.Sub(last) > uploadStaleAfter {
+			stale = append(stale, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, u := range stale {
+		err = deleteTusUpload(u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hideStagingDir() {
+	if !goIgnoreFiles.Contains(uploadStagingDir) {
+		goIgnoreFiles = append(goIgnoreFiles, uploadStagingDir)
+	}
+}
+
+// startUploads hides the staging directory from listings and periodically
+// prunes abandoned uploads.
+func startUploads() {
+	if len(goServUploadDirs) == 0 {
+		return
+	}
+	hideStagingDir()
+	go func() {
+		for {
+			err := pruneStaleUploads(time.Now())
+			if err != nil {
+				slog.Warn("prune uploads", "err", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
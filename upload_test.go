@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"movie.mkv", "movie.mkv"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\boot.ini`, "boot.ini"},
+		{"/abs/path.txt", "path.txt"},
+		{".hidden", "hidden"},
+		{"  spaced .txt ", "spaced .txt"},
+		{"bad\x00na\nme.txt", "badname.txt"},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127)},
+		{"..", ""},
+		{".", ""},
+		{"", ""},
+		{"dir/", "dir"},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeFilename(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("sanitizeFilename(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// withUploads enables uploads below dirs for the duration of the test.
+func withUploads(t *testing.T, maxSize int64, quota int64, dirs ...string) {
+	t.Helper()
+	savedDirs, savedMax, savedQuota := goServUploadDirs, goServUploadMaxSize, goServUploadQuota
+	goServUploadDirs, goServUploadMaxSize, goServUploadQuota = dirs, maxSize, quota
+	t.Cleanup(func() {
+		goServUploadDirs, goServUploadMaxSize, goServUploadQuota = savedDirs, savedMax, savedQuota
+	})
+}
+
+func postUpload(t *testing.T, dir string, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/_/api/upload?path="+dir, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("X-CSRF-Token", "t0ken")
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+	w := httptest.NewRecorder()
+	handleUploadAPI(w, r)
+	return w
+}
+
+func TestMultipartUpload(t *testing.T) {
+	dir := setupServedDir(t, "inbox/existing.txt", "readonly/a.txt")
+	withUploads(t, 16, 0, "inbox")
+	err := os.Symlink(filepath.Join(dir, "readonly"), filepath.Join(dir, "inbox", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name  string
+		dir   string
+		file  string
+		data  string
+		want  int
+		saved string
+	}{
+		{"ok", "inbox", "new.txt", "hello", http.StatusOK, "inbox/new.txt"},
+		{"traversal name", "inbox", "../../escape.txt", "x", http.StatusOK, "inbox/escape.txt"},
+		{"not enabled", "readonly", "b.txt", "x", http.StatusForbidden, ""},
+		{"parent", ".", "b.txt", "x", http.StatusForbidden, ""},
+		{"traversal dir", "inbox/../readonly", "b.txt", "x", http.StatusForbidden, ""},
+		{"symlink out", "inbox/link", "b.txt", "x", http.StatusForbidden, ""},
+		{"exists", "inbox", "existing.txt", "x", http.StatusConflict, ""},
+		{"too large", "inbox", "big.txt", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postUpload(t, tt.dir, map[string]string{tt.file: tt.data})
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.saved == "" {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(tt.saved))); err != nil {
+				t.Errorf("%s not saved: %v", tt.saved, err)
+			}
+		})
+	}
+	if v, _ := os.ReadFile(filepath.Join(dir, "inbox", "existing.txt")); string(v) != "content" {
+		t.Errorf("existing file overwritten: %q", v)
+	}
+	staged, _ := os.ReadDir(filepath.Join(dir, uploadStagingDir))
+	if len(staged) != 0 {
+		t.Errorf("staging not cleaned up: %v", staged)
+	}
+}
+
+func TestUploadOutsideRoot(t *testing.T) {
+	dir := setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 0, "inbox")
+	outside := t.TempDir()
+	err := os.Symlink(outside, filepath.Join(dir, "inbox", "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := postUpload(t, "inbox/out", map[string]string{"x.txt": "x"}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x.txt")); err == nil {
+		t.Errorf("upload escaped goServDir")
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 10, "inbox")
+	if w := postUpload(t, "inbox", map[string]string{"b.txt": "abc"}); w.Code != http.StatusOK {
+		t.Fatalf("within quota: got %d", w.Code)
+	}
+	if w := postUpload(t, "inbox", map[string]string{"c.txt": "abc"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over quota: got %d", w.Code)
+	}
+}
+
+func tusRequest(t *testing.T, method string, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("X-CSRF-Token", "t0ken")
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handleTus(w, r)
+	return w
+}
+
+func TestTusUpload(t *testing.T) {
+	dir := setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 0, "inbox")
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("big.bin")) +
+		",path " + base64.StdEncoding.EncodeToString([]byte("inbox"))
+
+	w := tusRequest(t, "OPTIONS", "/_/api/tus/", "", nil)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Tus-Extension"), "creation") {
+		t.Fatalf("options: got %d %v", w.Code, w.Header())
+	}
+	w = tusRequest(t, "POST", "/_/api/tus/", "", map[string]string{"Upload-Length": "10", "Upload-Metadata": meta})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+	loc := w.Header().Get("Location")
+
+	patch := func(offset string, data string) *httptest.ResponseRecorder {
+		return tusRequest(t, "PATCH", loc, data, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		})
+	}
+	if w := patch("0", "01234"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk: got %d offset %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := patch("3", "34567"); w.Code != http.StatusConflict {
+		t.Errorf("wrong offset: got %d", w.Code)
+	}
+	// a PATCH in flight holds the upload, a second one must not append
+	id := strings.TrimPrefix(loc, "/_/api/tus/")
+	lockTusUpload(id)
+	if w := patch("5", "56789"); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "" {
+		t.Errorf("concurrent patch: got %d", w.Code)
+	}
+	unlockTusUpload(id)
+	if w := tusRequest(t, "HEAD", loc, "", nil); w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("head: got %v", w.Header())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "inbox", "big.bin")); err == nil {
+		t.Fatalf("partial upload visible")
+	}
+	if w := patch("5", "56789"); w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: got %d", w.Code)
+	}
+	if v, _ := os.ReadFile(filepath.Join(dir, "inbox", "big.bin")); string(v) != "0123456789" {
+		t.Errorf("got %q", v)
+	}
+	if w := tusRequest(t, "HEAD", loc, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("finished upload still resumable: %d", w.Code)
+	}
+}
+
+func TestTusTermination(t *testing.T) {
+	setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 0, "inbox")
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("x.bin")) +
+		",path " + base64.StdEncoding.EncodeToString([]byte("inbox"))
+	w := tusRequest(t, "POST", "/_/api/tus/", "", map[string]string{"Upload-Length": "10", "Upload-Metadata": meta})
+	loc := w.Header().Get("Location")
+	if w := tusRequest(t, "DELETE", loc, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d", w.Code)
+	}
+	if w := tusRequest(t, "HEAD", loc, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("terminated upload: got %d", w.Code)
+	}
+	meta = "filename " + base64.StdEncoding.EncodeToString([]byte("x.bin")) +
+		",path " + base64.StdEncoding.EncodeToString([]byte("."))
+	if w := tusRequest(t, "POST", "/_/api/tus/", "", map[string]string{"Upload-Length": "1", "Upload-Metadata": meta}); w.Code != http.StatusForbidden {
+		t.Errorf("create outside upload dir: got %d", w.Code)
+	}
+}
+
+func TestTusQuota(t *testing.T) {
+	setupServedDir(t, "quota-inbox/a.txt")
+	withUploads(t, 0, 10, "quota-inbox")
+	create := func(name string, length string) *httptest.ResponseRecorder {
+		meta := "filename " + base64.StdEncoding.EncodeToString([]byte(name)) +
+			",path " + base64.StdEncoding.EncodeToString([]byte("quota-inbox"))
+		return tusRequest(t, "POST", "/_/api/tus/", "", map[string]string{"Upload-Length": length, "Upload-Metadata": meta})
+	}
+	// 7 bytes are used, an open upload of 3 reserves the rest
+	w := create("b.bin", "3")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("within quota: got %d", w.Code)
+	}
+	first := w.Header().Get("Location")
+	if w := create("c.bin", "1"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over reserved quota: got %d", w.Code)
+	}
+	if w := postUpload(t, "quota-inbox", map[string]string{"d.txt": "x"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("multipart over reserved quota: got %d", w.Code)
+	}
+	if w := tusRequest(t, "DELETE", first, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d", w.Code)
+	}
+	w = create("e.bin", "2")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("after release: got %d", w.Code)
+	}
+	// completion checks again, against the quota in force by then
+	goServUploadQuota = 8
+	w = tusRequest(t, "PATCH", w.Header().Get("Location"), "ab", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("completion over quota: got %d", w.Code)
+	}
+}
+
+// slowBody returns a body that arrives in chunks, pause apart.
+func slowBody(chunks []string, pause time.Duration) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, c := range chunks {
+			time.Sleep(pause)
+			if _, err := pw.Write([]byte(c)); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+func TestUploadSlowBody(t *testing.T) {
+	dir := setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 0, "inbox")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_/api/tus/") {
+			handleTus(w, r)
+			return
+		}
+		handleUploadAPI(w, r)
+	}))
+	srv.Config.ReadTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	send := func(method string, target string, body io.Reader, headers map[string]string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, srv.URL+target, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-CSRF-Token", "t0ken")
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+		res.Body.Close()
+		return res
+	}
+	// both bodies take five times the ReadTimeout to arrive
+	chunks := strings.Split("0123456789", "")
+
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	mw.CreateFormFile("file", "slow.txt")
+	tail := "\r\n--" + mw.Boundary() + "--\r\n"
+	body := io.MultiReader(&head, slowBody(chunks, 100*time.Millisecond), strings.NewReader(tail))
+	res := send("POST", "/_/api/upload?path=inbox", body, map[string]string{"Content-Type": mw.FormDataContentType()})
+	if v, _ := os.ReadFile(filepath.Join(dir, "inbox", "slow.txt")); res.StatusCode != http.StatusOK || string(v) != "0123456789" {
+		t.Errorf("multipart: got %d %q", res.StatusCode, v)
+	}
+
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("slow.bin")) +
+		",path " + base64.StdEncoding.EncodeToString([]byte("inbox"))
+	w := tusRequest(t, "POST", "/_/api/tus/", "", map[string]string{"Upload-Length": "10", "Upload-Metadata": meta})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+	res = send("PATCH", w.Header().Get("Location"), slowBody(chunks, 100*time.Millisecond), map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if v, _ := os.ReadFile(filepath.Join(dir, "inbox", "slow.bin")); res.StatusCode != http.StatusNoContent || string(v) != "0123456789" {
+		t.Errorf("tus: got %d %q", res.StatusCode, v)
+	}
+}
+
+func TestPruneStaleUploads(t *testing.T) {
+	setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 0, "inbox")
+	create := func(name string) string {
+		meta := "filename " + base64.StdEncoding.EncodeToString([]byte(name)) +
+			",path " + base64.StdEncoding.EncodeToString([]byte("inbox"))
+		w := tusRequest(t, "POST", "/_/api/tus/", "", map[string]string{"Upload-Length": "10", "Upload-Metadata": meta})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: got %d", w.Code)
+		}
+		loc := w.Header().Get("Location")
+		u, err := getTusUpload(strings.TrimPrefix(loc, tusPrefix))
+		if err == nil {
+			u.Created = u.Created.Add(-uploadStaleAfter)
+			err = putTusUpload(u)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+	idle := create("idle.bin")
+	active := create("active.bin")
+	w := tusRequest(t, "PATCH", active, "01234", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("patch: got %d", w.Code)
+	}
+	err := pruneStaleUploads(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := tusRequest(t, "HEAD", idle, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("idle upload kept: %d", w.Code)
+	}
+	if w := tusRequest(t, "HEAD", active, "", nil); w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("upload pruned a week after creation despite a fresh PATCH: %d", w.Code)
+	}
+	err = pruneStaleUploads(time.Now().Add(uploadStaleAfter + time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := tusRequest(t, "HEAD", active, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("upload idle since its last PATCH kept: %d", w.Code)
+	}
+}
+
+func TestTusRequiresCSRF(t *testing.T) {
+	setupServedDir(t, "inbox/a.txt")
+	withUploads(t, 0, 0, "inbox")
+	r := httptest.NewRequest("POST", tusPrefix, nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Upload-Length", "1")
+	w := httptest.NewRecorder()
+	handleTus(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), csrfCookieName) {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchProgressTTL bounds how long partial playback is remembered between
+// range requests before it is forgotten.
+const watchProgressTTL = 6 * time.Hour
+
+type servedFileKey struct{}
+
+type servedFile struct {
+	size int64
+}
+
+// setServedFile tells logRequests that the request is answered with the
+// contents of a file of the given size.
+func setServedFile(r *http.Request, size int64) {
+	if sf, ok := r.Context().Value(servedFileKey{}).(*servedFile); ok {
+		sf.size = size
+	}
+}
+
+func withServedFile(r *http.Request) (*http.Request, *servedFile) {
+	sf := &servedFile{size: -1}
+	return r.WithContext(context.WithValue(r.Context(), servedFileKey{}, sf)), sf
+}
+
+type watchProgress struct {
+	bytes    int64
+	lastSeen time.Time
+}
+
+// WatchTracker accumulates bytes served per path across range requests and
+// reports when a file has been transferred enough to count as watched.
+type WatchTracker struct {
+	mu         sync.Mutex
+	minBytes   int64
+	minPercent float64
+	now        func() time.Time
+	progress   map[string]*watchProgress
+}
+
+func NewWatchTracker(minBytes int64, minPercent float64) *WatchTracker {
+	return &WatchTracker{
+		minBytes:   minBytes,
+		minPercent: minPercent,
+		now:        time.Now,
+		progress:   map[string]*watchProgress{},
+	}
+}
+
+func (wt *WatchTracker) threshold(size int64) int64 {
+	limit := size
+	if wt.minPercent > 0 {
+		limit = int64(float64(size) * wt.minPercent / 100)
+	}
+	if wt.minBytes > 0 && wt.minBytes < limit {
+		limit = wt.minBytes
+	}
+	if limit < 1 && size > 0 {
+		limit = 1
+	}
+	return limit
+}
+
+// record adds n served bytes of a file of the given size and returns true
+// once the configured threshold is reached.
+func (wt *WatchTracker) record(upath string, n int64, size int64) bool {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	now := wt.now()
+	for k, p := range wt.progress {
+		if now.Sub(p.lastSeen) > watchProgressTTL {
+			delete(wt.progress, k)
+		}
+	}
+	p, ok := wt.progress[upath]
+	if !ok {
+		p = &watchProgress{}
+		wt.progress[upath] = p
+	}
+	p.bytes += n
+	p.lastSeen = now
+	if p.bytes >= wt.threshold(size) {
+		delete(wt.progress, upath)
+		return true
+	}
+	return false
+}
+
+// watchTracker is built by startWatchTracker before the server accepts
+// requests, so handlers only ever read it.
+var watchTracker *WatchTracker
+
+// startWatchTracker builds the tracker for the -watched-bytes and
+// -watched-percent thresholds.
+func startWatchTracker() {
+	watchTracker = NewWatchTracker(goServWatchedBytes, goServWatchedPercent)
+}
+
+// cleanKey turns a client supplied path into a bolt key, the same form
+// logRequests records: slash separated, relative to goServDir, never
+// escaping it.
+func cleanKey(p string) string {
+	key := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if key == "" {
+		return "."
+	}
+	return key
+}
+
+// collectKeys returns the keys of the files and of the directories below
+// a directory, the directory itself included.
+func collectKeys(name string, key string) ([]string, []string, error) {
+	var keys, dirs []string
+	err := filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if goIgnoreFiles.Contains(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(name, p)
+		if err != nil {
+			return err
+		}
+		k := key
+		if rel != "." {
+			k = getKey(key, filepath.ToSlash(rel))
+		}
+		if d.IsDir() {
+			dirs = append(dirs, k)
+		} else {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	return keys, dirs, err
+}
+
+// handleWatchedAPI marks (POST) or unmarks (DELETE) a file as watched, or
+// everything below it when the path is a directory.
+func handleWatchedAPI(w http.ResponseWriter, r *http.Request) {
+	setHandlerName(r, "api")
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	p, err := url.PathUnescape(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	key := cleanKey(p)
+	name := filepath.Join(goServDir, key)
+	fh, err := os.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	bolton := GetBoltInstance()
+	count := 1
+	keys := []string{key}
+	if r.Method == http.MethodDelete {
+		err = bolton.delete(key, fh.IsDir())
+	} else if fh.IsDir() {
+		var dirs []string
+		keys, dirs, err = collectKeys(name, key)
+		if err == nil {
+			count = len(keys)
+			err = bolton.bulk(keys, dirs)
+		}
+	} else {
+		err = bolton.update(key)
+	}
+	if err != nil {
+		slog.Error("watched api", "path", key, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost {
+		linkIdentities(keys...)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"path":    key,
+		"watched": r.Method == http.MethodPost,
+		"count":   count,
+	})
+}
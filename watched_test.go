@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchTrackerThreshold(t *testing.T) {
+	var tests = []struct {
+		name       string
+		minBytes   int64
+		minPercent float64
+		chunks     []int64
+		want       []bool
+	}{
+		{"full transfer", 0, 0, []int64{50, 50}, []bool{false, true}},
+		{"percent across ranges", 0, 30, []int64{10, 10, 10}, []bool{false, false, true}},
+		{"bytes before percent", 15, 90, []int64{10, 10}, []bool{false, true}},
+		{"tiny probe", 0, 50, []int64{2}, []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wt := NewWatchTracker(tt.minBytes, tt.minPercent)
+			for i, n := range tt.chunks {
+				if got := wt.record("movie.mkv", n, 100); got != tt.want[i] {
+					t.Fatalf("chunk %d: got %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLogRequestsOnlyMarksServedFiles(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "season1"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "season1", "ep1.mkv"), make([]byte, 1000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir := goServDir
+	goServDir = dir
+	savedTracker := watchTracker
+	watchTracker = NewWatchTracker(0, 50)
+	defer func() {
+		goServDir = savedDir
+		watchTracker = savedTracker
+	}()
+	h := logRequests(http.HandlerFunc(handlePath))
+
+	serve := func(p string, rng string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = p
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	serve("season1", "")
+	if isWatched("season1") {
+		t.Errorf("directory listing marked watched")
+	}
+	serve("season1/missing.mkv", "")
+	if isWatched("season1/missing.mkv") {
+		t.Errorf("missing file marked watched")
+	}
+	if code := serve("season1/ep1.mkv", "bytes=0-99"); code != http.StatusPartialContent {
+		t.Fatalf("range request returned %d", code)
+	}
+	if isWatched("season1/ep1.mkv") {
+		t.Errorf("range probe marked watched")
+	}
+	serve("season1/ep1.mkv", "")
+	if !isWatched("season1/ep1.mkv") {
+		t.Errorf("full transfer not marked watched")
+	}
+}
+
+func TestWatchedAPI(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "show", "s01"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"show/s01/e1.mkv", "show/s01/e2.mkv", "show/notes.txt"} {
+		err = os.WriteFile(filepath.Join(dir, f), []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	savedDir := goServDir
+	goServDir = dir
+	defer func() { goServDir = savedDir }()
+
+	call := func(method string, p string, token string) int {
+		r := httptest.NewRequest(method, "/_/api/watched?path="+url.QueryEscape(p), nil)
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "t0ken"})
+		r.Header.Set("X-CSRF-Token", token)
+		w := httptest.NewRecorder()
+		handleWatchedAPI(w, r)
+		return w.Code
+	}
+
+	if code := call("POST", "show", "wrong"); code != http.StatusForbidden {
+		t.Fatalf("bad token: got %d", code)
+	}
+	if code := call("GET", "show", "t0ken"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: got %d", code)
+	}
+	if code := call("POST", "show", "t0ken"); code != http.StatusOK {
+		t.Fatalf("POST: got %d", code)
+	}
+	for _, k := range []string{"show", "show/s01", "show/s01/e1.mkv", "show/s01/e2.mkv", "show/notes.txt"} {
+		if !isWatched(k) {
+			t.Errorf("%s not marked", k)
+		}
+	}
+	if code := call("DELETE", "show/s01/e1.mkv", "t0ken"); code != http.StatusOK {
+		t.Fatalf("DELETE file: got %d", code)
+	}
+	if isWatched("show/s01/e1.mkv") || !isWatched("show/s01/e2.mkv") {
+		t.Errorf("file unmark touched the wrong keys")
+	}
+	if code := call("DELETE", "../show/s01", "t0ken"); code != http.StatusOK {
+		t.Fatalf("DELETE dir: got %d", code)
+	}
+	if isWatched("show/s01") || isWatched("show/s01/e2.mkv") {
+		t.Errorf("recursive unmark left keys behind")
+	}
+	if !isWatched("show/notes.txt") {
+		t.Errorf("recursive unmark removed a sibling")
+	}
+}
+
+func isWatched(key string) bool {
+	rec, ok := GetBoltInstance().getRecord(key)
+	return ok && rec.Watched
+}
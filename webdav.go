@@ -0,0 +1,809 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// davPrefix is where the WebDAV view of goServDir is mounted, under /_/ so
+// it cannot shadow a served directory.
+const davPrefix = "/_/dav/"
+
+// davLockTimeout is the lifetime of a lock unless the client asks for less.
+const davLockTimeout = 10 * time.Minute
+
+// getDavHref returns the escaped URL of key, collections ending in a slash.
+func getDavHref(key string, dir bool) string {
+	href := strings.TrimSuffix(davPrefix, "/")
+	if key != "." {
+		for _, elem := range strings.Split(key, "/") {
+			href += "/" + url.PathEscape(elem)
+		}
+	}
+	if dir {
+		href += "/"
+	}
+	return href
+}
+
+// handleWebDAV serves goServDir as a WebDAV class 1 resource, class 2 when
+// -webdav-write allows changes. Requests arrive with davPrefix stripped, so
+// the key is derived the same way as in the file chain. Reads follow
+// symlinks like listings do; writes must resolve inside goServDir.
+func handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	key := cleanKey(r.URL.Path)
+	if isHiddenKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		setHandlerName(r, "webdav")
+		allow := "OPTIONS, GET, HEAD, PROPFIND"
+		class := "1"
+		if goServWebDAVWrite {
+			allow += ", PUT, DELETE, MKCOL, COPY, MOVE, PROPPATCH, LOCK, UNLOCK"
+			class = "1, 2"
+		}
+		w.Header().Set("Allow", allow)
+		w.Header().Set("DAV", class)
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet, http.MethodHead:
+		// listings, progress tracking and metrics as for the file chain
+		logRequests(http.HandlerFunc(handlePath)).ServeHTTP(w, r)
+		return
+	case "PROPFIND":
+		setHandlerName(r, "webdav")
+		davPropfind(w, r, key)
+		return
+	}
+	setHandlerName(r, "webdav")
+	if !goServWebDAVWrite {
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		http.Error(w, "WebDAV is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	var status int
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		extendReadDeadline(w, r)
+		status, err = davPut(r, key)
+	case http.MethodDelete:
+		status, err = davDelete(r, key)
+	case "MKCOL":
+		status, err = davMkcol(r, key)
+	case "COPY", "MOVE":
+		status, err = davCopyMove(r, key)
+	case "PROPPATCH":
+		davProppatch(w, r, key)
+		return
+	case "LOCK":
+		davLock(w, r, key)
+		return
+	case "UNLOCK":
+		status, err = davUnlock(r, key)
+	default:
+		http.Error(w, "Invalid request", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		slog.Warn("webdav", "method", r.Method, "path", key, "err", err)
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+	}
+	if status >= 300 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// davParent resolves the directory that will hold key, refusing symlinks
+// that lead out of goServDir.
+func davParent(key string) (string, int, error) {
+	if key == "." {
+		return "", http.StatusForbidden, nil
+	}
+	dir, _, err := resolveServedDir(path.Dir(key))
+	switch {
+	case errors.Is(err, errOutsideRoot):
+		return "", http.StatusForbidden, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return "", http.StatusConflict, nil
+	case err != nil:
+		return "", http.StatusConflict, err
+	}
+	return filepath.Join(dir, path.Base(key)), 0, nil
+}
+
+func davPut(r *http.Request, key string) (int, error) {
+	name, status, err := davParent(key)
+	if status != 0 {
+		return status, err
+	}
+	if !canUpload(path.Dir(key)) {
+		return http.StatusForbidden, nil
+	}
+	if status := checkDavLock(r, key, false); status != 0 {
+		return status, nil
+	}
+	fi, err := os.Stat(name)
+	if err == nil && fi.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+	existed := err == nil
+	if existed && !canManage(path.Dir(key), "delete") {
+		return http.StatusForbidden, nil
+	}
+	if goServUploadMaxSize > 0 && r.ContentLength > goServUploadMaxSize {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+	staging, err := getStagingDir()
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(staging, "dav-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	limit := goServUploadMaxSize
+	if limit <= 0 {
+		limit = 1<<63 - 2
+	}
+	n, err := io.Copy(tmp, io.LimitReader(r.Body, limit+1))
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if n > limit {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+	uploadQuotaMu.Lock()
+	defer uploadQuotaMu.Unlock()
+	err = davCheckQuota(key, n, name)
+	if err != nil {
+		return davQuotaStatus(err)
+	}
+	if existed {
+		if status, err := davTrash(r, key); status != 0 || err != nil {
+			return status, err
+		}
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("webdav put", "path", key, "bytes", n, "user", getRequestUser(r))
+	if existed {
+		return http.StatusNoContent, nil
+	}
+	dirsChanged(key)
+	return http.StatusCreated, nil
+}
+
+// davCheckQuota enforces -upload-quota when size bytes arrive at key in an
+// upload directory, replacing whatever is at name. Callers hold
+// uploadQuotaMu until the bytes are in place.
+func davCheckQuota(key string, size int64, name string) error {
+	root, ok := getUploadRoot(path.Dir(key))
+	if !ok || goServUploadQuota <= 0 {
+		return nil
+	}
+	replaced, err := getTreeSize(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return checkUploadQuota(root, size-replaced, "")
+}
+
+// davQuotaStatus answers a failed davCheckQuota, with 507 Insufficient
+// Storage as WebDAV clients expect for a full quota.
+func davQuotaStatus(err error) (int, error) {
+	if errors.Is(err, errUploadQuota) {
+		return http.StatusInsufficientStorage, nil
+	}
+	return 0, err
+}
+
+func davDelete(r *http.Request, key string) (int, error) {
+	name, status, err := davParent(key)
+	if status != 0 {
+		return status, err
+	}
+	if !canManage(path.Dir(key), "delete") {
+		return http.StatusForbidden, nil
+	}
+	if status := checkDavLock(r, key, true); status != 0 {
+		return status, nil
+	}
+	if _, err := os.Lstat(name); err != nil {
+		return http.StatusNotFound, nil
+	}
+	if status, err := davTrash(r, key); status != 0 || err != nil {
+		return status, err
+	}
+	return http.StatusNoContent, nil
+}
+
+// davTrash moves the entry key into the trash like a delete from the file
+// chain, so WebDAV deletes and overwrites stay recoverable for
+// -trash-retention.
+func davTrash(r *http.Request, key string) (int, error) {
+	bin, err := trashEntry(key, time.Now())
+	switch {
+	case errors.Is(err, errManageDenied):
+		return http.StatusForbidden, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound, nil
+	case err != nil:
+		return 0, err
+	}
+	slog.Info("webdav delete", "path", key, "trash", bin, "user", getRequestUser(r))
+	return 0, nil
+}
+
+func davMkcol(r *http.Request, key string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+	name, status, err := davParent(key)
+	if status != 0 {
+		return status, err
+	}
+	if !canManage(path.Dir(key), "mkdir") {
+		return http.StatusForbidden, nil
+	}
+	if status := checkDavLock(r, key, false); status != 0 {
+		return status, nil
+	}
+	err = os.Mkdir(name, 0755)
+	if errors.Is(err, fs.ErrExist) {
+		return http.StatusMethodNotAllowed, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	dirsChanged(key)
+	return http.StatusCreated, nil
+}
+
+// getDavDestination turns the Destination header into a key.
+func getDavDestination(r *http.Request) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", false
+	}
+	p := u.Path
+	if !strings.HasPrefix(p+"/", davPrefix) {
+		return "", false
+	}
+	return cleanKey(strings.TrimPrefix(p, strings.TrimSuffix(davPrefix, "/"))), true
+}
+
+func davCopyMove(r *http.Request, key string) (int, error) {
+	dst, ok := getDavDestination(r)
+	if !ok {
+		return http.StatusBadGateway, nil
+	}
+	if key == "." || dst == "." || isHiddenKey(dst) {
+		return http.StatusForbidden, nil
+	}
+	if dst == key || strings.HasPrefix(dst, key+"/") {
+		return http.StatusForbidden, nil
+	}
+	src, status, err := davParent(key)
+	if status != 0 {
+		return status, err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return http.StatusNotFound, nil
+	}
+	name, status, err := davParent(dst)
+	if status != 0 {
+		return status, err
+	}
+	// a move needs rename on both sides as in the file chain, a copy adds
+	// new content like an upload
+	if r.Method == "MOVE" && !(canManage(path.Dir(key), "rename") && canManage(path.Dir(dst), "rename")) {
+		return http.StatusForbidden, nil
+	}
+	if r.Method == "COPY" && !canUpload(path.Dir(dst)) {
+		return http.StatusForbidden, nil
+	}
+	if status := checkDavLock(r, dst, true); status != 0 {
+		return status, nil
+	}
+	if r.Method == "MOVE" {
+		if status := checkDavLock(r, key, true); status != 0 {
+			return status, nil
+		}
+	}
+	// a move within one upload directory does not change its usage
+	srcRoot, fromRoot := getUploadRoot(path.Dir(key))
+	dstRoot, _ := getUploadRoot(path.Dir(dst))
+	if r.Method == "COPY" || !fromRoot || srcRoot != dstRoot {
+		uploadQuotaMu.Lock()
+		defer uploadQuotaMu.Unlock()
+		size, err := getTreeSize(src)
+		if err == nil {
+			err = davCheckQuota(dst, size, name)
+		}
+		if err != nil {
+			return davQuotaStatus(err)
+		}
+	}
+	_, err = os.Lstat(name)
+	existed := err == nil
+	if existed {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, nil
+		}
+		if status, err := davTrash(r, dst); status != 0 || err != nil {
+			return status, err
+		}
+	}
+	if r.Method == "MOVE" {
+		err = os.Rename(src, name)
+		if err != nil {
+			return 0, err
+		}
+		err = GetBoltInstance().rename(key, dst)
+		if err != nil {
+			slog.Warn("webdav rename", "from", key, "to", dst, "err", err)
+		}
+	} else {
+		err = copyTree(src, name, fi.IsDir() && r.Header.Get("Depth") != "0")
+		if err != nil {
+			return 0, err
+		}
+		dirsChanged(dst)
+	}
+	slog.Info("webdav "+strings.ToLower(r.Method), "from", key, "to", dst, "user", getRequestUser(r))
+	if existed {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+// copyTree copies the file or directory src to dst, descending into
+// directories only when recursive is set.
+func copyTree(src string, dst string, recursive bool) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return copyFile(src, dst, fi.Mode().Perm())
+	}
+	err = os.Mkdir(dst, fi.Mode().Perm())
+	if err != nil || !recursive {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if goIgnoreFiles.Contains(e.Name()) {
+			continue
+		}
+		err = copyTree(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name()), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type davPropfindBody struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// davProp is a property of a resource, its value already XML encoded.
+type davProp struct {
+	name  xml.Name
+	value string
+}
+
+func davEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// getDavProps returns the live properties of a resource. There are no
+// dead properties: goserv has nowhere to keep them.
+func getDavProps(key string, fi fs.FileInfo) []davProp {
+	dav := func(name string, value string) davProp {
+		return davProp{xml.Name{Space: "DAV:", Local: name}, value}
+	}
+	displayName := fi.Name()
+	if key == "." {
+		displayName = "goserv"
+	}
+	props := []davProp{
+		dav("displayname", davEscape(displayName)),
+		dav("creationdate", fi.ModTime().UTC().Format(time.RFC3339)),
+		dav("getlastmodified", fi.ModTime().UTC().Format(http.TimeFormat)),
+	}
+	if fi.IsDir() {
+		props = append(props, dav("resourcetype", "<D:collection/>"))
+	} else {
+		ctype := mime.TypeByExtension(path.Ext(fi.Name()))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		props = append(props,
+			dav("resourcetype", ""),
+			dav("getcontentlength", strconv.FormatInt(fi.Size(), 10)),
+			dav("getcontenttype", davEscape(ctype)),
+			dav("getetag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())),
+		)
+	}
+	if goServWebDAVWrite {
+		props = append(props,
+			dav("supportedlock", "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"),
+			dav("lockdiscovery", getLockDiscovery(key)),
+		)
+	}
+	return props
+}
+
+func writeDavProp(b *strings.Builder, p davProp, withValue bool) {
+	open, end := "D:"+p.name.Local, "D:"+p.name.Local
+	if p.name.Space != "DAV:" {
+		open = fmt.Sprintf(`x:%s xmlns:x="%s"`, p.name.Local, davEscape(p.name.Space))
+		end = "x:" + p.name.Local
+	}
+	if !withValue || p.value == "" {
+		fmt.Fprintf(b, "<%s/>", open)
+		return
+	}
+	fmt.Fprintf(b, "<%s>%s</%s>", open, p.value, end)
+}
+
+// writeDavResponse appends the multistatus response of one resource:
+// requested properties it has under 200, unknown ones under 404.
+func writeDavResponse(b *strings.Builder, key string, fi fs.FileInfo, req davPropfindBody) {
+	props := getDavProps(key, fi)
+	found, missing := props, []davProp(nil)
+	if req.Prop != nil && req.AllProp == nil {
+		found = nil
+		for _, n := range req.Prop.Names {
+			p := davProp{name: n.XMLName}
+			ok := false
+			for _, have := range props {
+				if have.name == n.XMLName {
+					p, ok = have, true
+					break
+				}
+			}
+			if ok {
+				found = append(found, p)
+			} else {
+				missing = append(missing, p)
+			}
+		}
+	}
+	fmt.Fprintf(b, "<D:response><D:href>%s</D:href>", davEscape(getDavHref(key, fi.IsDir())))
+	for _, ps := range []struct {
+		props  []davProp
+		status int
+	}{{found, http.StatusOK}, {missing, http.StatusNotFound}} {
+		if len(ps.props) == 0 {
+			continue
+		}
+		b.WriteString("<D:propstat><D:prop>")
+		for _, p := range ps.props {
+			writeDavProp(b, p, req.PropName == nil)
+		}
+		fmt.Fprintf(b, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>", ps.status, http.StatusText(ps.status))
+	}
+	b.WriteString("</D:response>")
+}
+
+func davPropfind(w http.ResponseWriter, r *http.Request, key string) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+		return
+	}
+	var req davPropfindBody
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		err = xml.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, "Invalid PROPFIND body", http.StatusBadRequest)
+			return
+		}
+	}
+	name := filepath.Join(goServDir, filepath.FromSlash(key))
+	fi, err := os.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(xml.Header + `<D:multistatus xmlns:D="DAV:">`)
+	writeDavResponse(&b, key, fi, req)
+	if fi.IsDir() && depth == "1" {
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			slog.Warn("read dir", "dir", name, "err", err)
+		}
+		for _, e := range entries {
+			child := getKey(key, e.Name())
+			if isHiddenKey(child) {
+				continue
+			}
+			cfi, err := os.Stat(filepath.Join(name, e.Name()))
+			if err != nil {
+				continue
+			}
+			writeDavResponse(&b, child, cfi, req)
+		}
+	}
+	b.WriteString("</D:multistatus>")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+// davProppatch refuses every property change: only live properties exist
+// and none of them can be set.
+func davProppatch(w http.ResponseWriter, r *http.Request, key string) {
+	if _, err := os.Stat(filepath.Join(goServDir, filepath.FromSlash(key))); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Updates []struct {
+			Prop struct {
+				Names []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:",any"`
+	}
+	err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid PROPPATCH body", http.StatusBadRequest)
+		return
+	}
+	fi, _ := os.Stat(filepath.Join(goServDir, filepath.FromSlash(key)))
+	var b strings.Builder
+	b.WriteString(xml.Header + `<D:multistatus xmlns:D="DAV:">`)
+	fmt.Fprintf(&b, "<D:response><D:href>%s</D:href><D:propstat><D:prop>", davEscape(getDavHref(key, fi != nil && fi.IsDir())))
+	for _, u := range req.Updates {
+		for _, n := range u.Prop.Names {
+			writeDavProp(&b, davProp{name: n.XMLName}, false)
+		}
+	}
+	fmt.Fprintf(&b, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat></D:response></D:multistatus>", http.StatusForbidden, http.StatusText(http.StatusForbidden))
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+// davLockInfo is an exclusive write lock on a resource and everything
+// below it. Locks live in memory only; clients renew them anyway.
+type davLockInfo struct {
+	token   string
+	owner   davLockOwner
+	expires time.Time
+}
+
+// davLockOwner is what a client says about itself in a lock request: a
+// DAV:href or plain text. Other markup is dropped rather than echoed.
+type davLockOwner struct {
+	Href string `xml:"DAV: href"`
+	Text string `xml:",chardata"`
+}
+
+func (o davLockOwner) String() string {
+	if href := strings.TrimSpace(o.Href); href != "" {
+		return "<D:href>" + davEscape(href) + "</D:href>"
+	}
+	return davEscape(strings.TrimSpace(o.Text))
+}
+
+var davLocks = struct {
+	sync.Mutex
+	m map[string]davLockInfo
+}{m: map[string]davLockInfo{}}
+
+// findDavLock returns the key and lock covering key, if any.
+func findDavLock(key string, now time.Time) (string, davLockInfo, bool) {
+	for k := key; ; k = path.Dir(k) {
+		if l, ok := davLocks.m[k]; ok {
+			if now.Before(l.expires) {
+				return k, l, true
+			}
+			delete(davLocks.m, k)
+		}
+		if k == "." {
+			return "", davLockInfo{}, false
+		}
+	}
+}
+
+// checkDavLock returns 423 Locked when key is locked and the If header of
+// the request does not name the lock token. With tree set, as for DELETE
+// and MOVE of a collection, the locks held on anything below key count
+// too.
+func checkDavLock(r *http.Request, key string, tree bool) int {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	now := time.Now()
+	held := func(l davLockInfo) bool {
+		return strings.Contains(r.Header.Get("If"), "<"+l.token+">")
+	}
+	if _, l, ok := findDavLock(key, now); ok && !held(l) {
+		return http.StatusLocked
+	}
+	if !tree {
+		return 0
+	}
+	for k, l := range davLocks.m {
+		if k != key && inScope(k, key) && now.Before(l.expires) && !held(l) {
+			return http.StatusLocked
+		}
+	}
+	return 0
+}
+
+func getLockDiscovery(key string) string {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	k, l, ok := findDavLock(key, time.Now())
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>"+
+		"<D:depth>infinity</D:depth><D:owner>%s</D:owner><D:timeout>Second-%d</D:timeout>"+
+		"<D:locktoken><D:href>%s</D:href></D:locktoken><D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		l.owner, int(time.Until(l.expires).Seconds()), davEscape(l.token), davEscape(getDavHref(k, false)))
+}
+
+func getDavTimeout(header string) time.Duration {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if s, ok := strings.CutPrefix(t, "Second-"); ok {
+			n, err := strconv.Atoi(s)
+			if err == nil && n > 0 && time.Duration(n)*time.Second < davLockTimeout {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return davLockTimeout
+}
+
+// davLock creates a lock, or refreshes the one named in the If header when
+// the request has no body. Locking a missing resource creates it empty.
+func davLock(w http.ResponseWriter, r *http.Request, key string) {
+	var req struct {
+		Owner davLockOwner `xml:"DAV: owner"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	refresh := len(strings.TrimSpace(string(body))) == 0
+	if !refresh && xml.Unmarshal(body, &req) != nil {
+		http.Error(w, "Invalid LOCK body", http.StatusBadRequest)
+		return
+	}
+	name, status, err := davParent(key)
+	if status != 0 {
+		if err != nil {
+			slog.Warn("webdav lock", "path", key, "err", err)
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	now := time.Now()
+	timeout := getDavTimeout(r.Header.Get("Timeout"))
+	davLocks.Lock()
+	k, l, locked := findDavLock(key, now)
+	if refresh {
+		if !locked || !strings.Contains(r.Header.Get("If"), "<"+l.token+">") {
+			davLocks.Unlock()
+			http.Error(w, "No matching lock", http.StatusPreconditionFailed)
+			return
+		}
+		l.expires = now.Add(timeout)
+		davLocks.m[k] = l
+	} else {
+		if locked {
+			davLocks.Unlock()
+			http.Error(w, http.StatusText(http.StatusLocked), http.StatusLocked)
+			return
+		}
+		l = davLockInfo{token: "opaquelocktoken:" + randomHex(16), owner: req.Owner, expires: now.Add(timeout)}
+		davLocks.m[key] = l
+	}
+	davLocks.Unlock()
+	status = http.StatusOK
+	if !refresh && canUpload(path.Dir(key)) {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			dirsChanged(key)
+			status = http.StatusCreated
+		}
+	}
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header+`<D:prop xmlns:D="DAV:"><D:lockdiscovery>`+getLockDiscovery(key)+`</D:lockdiscovery></D:prop>`)
+}
+
+func davUnlock(r *http.Request, key string) (int, error) {
+	token := strings.Trim(r.Header.Get("Lock-Token"), "<>")
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	k, l, ok := findDavLock(key, time.Now())
+	if !ok || l.token != token {
+		return http.StatusConflict, nil
+	}
+	delete(davLocks.m, k)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// davHandler is the WebDAV route as main mounts it.
+var davHandler = http.StripPrefix(davPrefix, checkAccessToken(http.HandlerFunc(handleWebDAV)))
+
+func davRequest(t *testing.T, method string, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, davPrefix+target, strings.NewReader(body))
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	davHandler.ServeHTTP(w, r)
+	return w
+}
+
+// withWebDAVWrite enables -webdav-write with uploads and every -manage
+// operation allowed throughout goServDir.
+func withWebDAVWrite(t *testing.T) {
+	t.Helper()
+	saved := goServWebDAVWrite
+	goServWebDAVWrite = true
+	t.Cleanup(func() { goServWebDAVWrite = saved })
+	withUploads(t, 0, 0, ".")
+	withManage(t, ".")
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func parseMultistatus(t *testing.T, w *httptest.ResponseRecorder) davMultistatus {
+	t.Helper()
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("got %d, want 207: %s", w.Code, w.Body.String())
+	}
+	var ms davMultistatus
+	err := xml.Unmarshal(w.Body.Bytes(), &ms)
+	if err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	return ms
+}
+
+func TestWebDAVOptions(t *testing.T) {
+	setupServedDir(t, "a.txt")
+	w := davRequest(t, "OPTIONS", "", "", nil)
+	if w.Header().Get("DAV") != "1" || strings.Contains(w.Header().Get("Allow"), "PUT") {
+		t.Errorf("read-only: got DAV %q Allow %q", w.Header().Get("DAV"), w.Header().Get("Allow"))
+	}
+	withWebDAVWrite(t)
+	w = davRequest(t, "OPTIONS", "", "", nil)
+	if w.Header().Get("DAV") != "1, 2" || !strings.Contains(w.Header().Get("Allow"), "MKCOL") {
+		t.Errorf("read-write: got DAV %q Allow %q", w.Header().Get("DAV"), w.Header().Get("Allow"))
+	}
+}
+
+func TestWebDAVPropfind(t *testing.T) {
+	setupServedDir(t, "show/e01.mkv", "show/sub dir/e02.mkv", "show/.hidden", "top.txt")
+	saved := goIgnoreFiles
+	goIgnoreFiles = append(arrayFlags{}, ".hidden")
+	defer func() { goIgnoreFiles = saved }()
+
+	ms := parseMultistatus(t, davRequest(t, "PROPFIND", "show", "", map[string]string{"Depth": "1"}))
+	var hrefs []string
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+	}
+	want := []string{davPrefix + "show/", davPrefix + "show/e01.mkv", davPrefix + "show/sub%20dir/"}
+	if strings.Join(hrefs, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", hrefs, want)
+	}
+	if !strings.Contains(ms.Responses[0].Propstat[0].Prop.Inner, "collection") {
+		t.Errorf("collection lacks resourcetype: %s", ms.Responses[0].Propstat[0].Prop.Inner)
+	}
+
+	ms = parseMultistatus(t, davRequest(t, "PROPFIND", "top.txt", "", map[string]string{"Depth": "0"}))
+	if len(ms.Responses) != 1 || !strings.Contains(ms.Responses[0].Propstat[0].Prop.Inner, "<D:getcontentlength>7<") {
+		t.Errorf("depth 0: %+v", ms)
+	}
+
+	body := `<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getcontentlength/><foo xmlns="http://example.com/ns"/></prop></propfind>`
+	ms = parseMultistatus(t, davRequest(t, "PROPFIND", "top.txt", body, map[string]string{"Depth": "0"}))
+	ps := ms.Responses[0].Propstat
+	if len(ps) != 2 || !strings.Contains(ps[0].Status, "200") || !strings.Contains(ps[1].Status, "404") || !strings.Contains(ps[1].Prop.Inner, "foo") {
+		t.Errorf("named props: %+v", ps)
+	}
+
+	var tests = []struct {
+		name   string
+		target string
+		body   string
+		depth  string
+		want   int
+	}{
+		{"infinity", "show", "", "infinity", http.StatusForbidden},
+		{"no depth", "show", "", "", http.StatusForbidden},
+		{"bad xml", "show", "<propfind", "0", http.StatusBadRequest},
+		{"missing", "nope", "", "0", http.StatusNotFound},
+		{"ignored", "show/.hidden", "", "0", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := davRequest(t, "PROPFIND", tt.target, tt.body, map[string]string{"Depth": tt.depth}); w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebDAVReadOnly(t *testing.T) {
+	dir := setupServedDir(t, "a.txt")
+	if w := davRequest(t, "GET", "a.txt", "", nil); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("get: got %d %q", w.Code, w.Body.String())
+	}
+	for _, method := range []string{"PUT", "DELETE", "MKCOL", "MOVE", "COPY", "LOCK", "PROPPATCH"} {
+		w := davRequest(t, method, "a.txt", "x", map[string]string{"Destination": davPrefix + "b.txt"})
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: got %d", method, w.Code)
+		}
+	}
+	if v, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(v) != "content" {
+		t.Errorf("file changed: %q", v)
+	}
+}
+
+func TestWebDAVWrite(t *testing.T) {
+	dir := setupServedDir(t, "a.txt", "outside/x.txt")
+	withWebDAVWrite(t)
+	err := os.Symlink(t.TempDir(), filepath.Join(dir, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := func(key string) map[string]string {
+		return map[string]string{"Destination": "http://example.com" + davPrefix + key}
+	}
+	var steps = []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		want    int
+	}{
+		{"put new", "PUT", "new.txt", "hello", nil, http.StatusCreated},
+		{"put overwrite", "PUT", "new.txt", "hello again", nil, http.StatusNoContent},
+		{"put utf8", "PUT", "h%C3%A9llo.txt", "x", nil, http.StatusCreated},
+		{"put no parent", "PUT", "missing/a.txt", "x", nil, http.StatusConflict},
+		{"put escape", "PUT", "escape/a.txt", "x", nil, http.StatusForbidden},
+		{"mkcol", "MKCOL", "coll", "", nil, http.StatusCreated},
+		{"mkcol again", "MKCOL", "coll", "", nil, http.StatusMethodNotAllowed},
+		{"mkcol no parent", "MKCOL", "a/b/c", "", nil, http.StatusConflict},
+		{"copy", "COPY", "new.txt", "", dest("coll/copy.txt"), http.StatusCreated},
+		{"copy no overwrite", "COPY", "new.txt", "", map[string]string{"Destination": davPrefix + "coll/copy.txt", "Overwrite": "F"}, http.StatusPreconditionFailed},
+		{"copy overwrite", "COPY", "a.txt", "", dest("coll/copy.txt"), http.StatusNoContent},
+		{"copy foreign", "COPY", "a.txt", "", map[string]string{"Destination": "http://other.example/x"}, http.StatusBadGateway},
+		{"move", "MOVE", "coll", "", dest("moved"), http.StatusCreated},
+		{"move into itself", "MOVE", "moved", "", dest("moved/sub"), http.StatusForbidden},
+		{"delete", "DELETE", "moved", "", nil, http.StatusNoContent},
+		{"delete null", "DELETE", "moved", "", nil, http.StatusNotFound},
+		{"delete root", "DELETE", "", "", nil, http.StatusForbidden},
+	}
+	for _, s := range steps {
+		if w := davRequest(t, s.method, s.target, s.body, s.headers); w.Code != s.want {
+			t.Fatalf("%s: got %d, want %d: %s", s.name, w.Code, s.want, w.Body.String())
+		}
+	}
+	if v, _ := os.ReadFile(filepath.Join(dir, "new.txt")); string(v) != "hello again" {
+		t.Errorf("new.txt: %q", v)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "héllo.txt")); err != nil {
+		t.Errorf("utf8 name: %v", err)
+	}
+}
+
+func TestWebDAVQuota(t *testing.T) {
+	dir := setupServedDir(t, "inbox/a.txt", "big.txt")
+	withWebDAVWrite(t)
+	withUploads(t, 0, 10, "inbox", "other")
+	err := os.Mkdir(filepath.Join(dir, "other"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := map[string]string{"Destination": davPrefix + "inbox/copy.txt"}
+	var steps = []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		want    int
+	}{
+		{"put within quota", "PUT", "inbox/b.txt", "abc", nil, http.StatusCreated},
+		{"put over quota", "PUT", "inbox/c.txt", "x", nil, http.StatusInsufficientStorage},
+		{"overwrite same size", "PUT", "inbox/b.txt", "xyz", nil, http.StatusNoContent},
+		{"put elsewhere", "PUT", "other/c.txt", "abcdefghij", nil, http.StatusCreated},
+		{"copy over quota", "COPY", "big.txt", "", dest, http.StatusInsufficientStorage},
+		{"move over quota", "MOVE", "big.txt", "", dest, http.StatusInsufficientStorage},
+		{"move within", "MOVE", "inbox/b.txt", "", map[string]string{"Destination": davPrefix + "inbox/d.txt"}, http.StatusCreated},
+	}
+	for _, s := range steps {
+		if w := davRequest(t, s.method, s.target, s.body, s.headers); w.Code != s.want {
+			t.Fatalf("%s: got %d, want %d: %s", s.name, w.Code, s.want, w.Body.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.txt")); err != nil {
+		t.Errorf("refused move removed the source: %v", err)
+	}
+}
+
+func TestWebDAVMoveKeepsWatched(t *testing.T) {
+	setupServedDir(t, "show/e01.mkv")
+	withWebDAVWrite(t)
+	bolton := GetBoltInstance()
+	err := bolton.update("show/e01.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := davRequest(t, "MOVE", "show", "", map[string]string{"Destination": davPrefix + "renamed"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("move: got %d", w.Code)
+	}
+	if len(bolton.get("renamed/e01.mkv")) == 0 {
+		t.Errorf("watched state not moved")
+	}
+	if len(bolton.get("show/e01.mkv")) != 0 {
+		t.Errorf("old key kept")
+	}
+}
+
+func TestWebDAVLocks(t *testing.T) {
+	setupServedDir(t, "a.txt")
+	withWebDAVWrite(t)
+	body := `<?xml version="1.0"?><lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype><owner>litmus</owner></lockinfo>`
+	w := davRequest(t, "LOCK", "a.txt", body, map[string]string{"Timeout": "Second-60"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("lock: got %d %s", w.Code, w.Body.String())
+	}
+	token := w.Header().Get("Lock-Token")
+	if !strings.HasPrefix(token, "<opaquelocktoken:") || !strings.Contains(w.Body.String(), "litmus") {
+		t.Fatalf("lock: token %q body %s", token, w.Body.String())
+	}
+	if w := davRequest(t, "LOCK", "a.txt", body, nil); w.Code != http.StatusLocked {
+		t.Errorf("second lock: got %d", w.Code)
+	}
+	if w := davRequest(t, "PUT", "a.txt", "x", nil); w.Code != http.StatusLocked {
+		t.Errorf("put without token: got %d", w.Code)
+	}
+	if w := davRequest(t, "PUT", "a.txt", "x", map[string]string{"If": "(" + token + ")"}); w.Code != http.StatusNoContent {
+		t.Errorf("put with token: got %d", w.Code)
+	}
+	if w := davRequest(t, "LOCK", "a.txt", "", map[string]string{"If": "(" + token + ")"}); w.Code != http.StatusOK {
+		t.Errorf("refresh: got %d", w.Code)
+	}
+	if w := davRequest(t, "UNLOCK", "a.txt", "", map[string]string{"Lock-Token": "<opaquelocktoken:wrong>"}); w.Code != http.StatusConflict {
+		t.Errorf("unlock wrong token: got %d", w.Code)
+	}
+	if w := davRequest(t, "UNLOCK", "a.txt", "", map[string]string{"Lock-Token": token}); w.Code != http.StatusNoContent {
+		t.Errorf("unlock: got %d", w.Code)
+	}
+	if w := davRequest(t, "DELETE", "a.txt", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("delete after unlock: got %d", w.Code)
+	}
+}
+
+func TestWebDAVLockOwnerEscaped(t *testing.T) {
+	setupServedDir(t, "a.txt", "b.txt")
+	withWebDAVWrite(t)
+	tests := []struct {
+		file  string
+		owner string
+		want  string
+	}{
+		{"a.txt", `<D:href>mailto:a@example.com</D:href>`, `<D:owner><D:href>mailto:a@example.com</D:href></D:owner>`},
+		{"b.txt", `&lt;script&gt;<D:evil>x</D:evil>`, `<D:owner>&lt;script&gt;</D:owner>`},
+	}
+	for _, tt := range tests {
+		body := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>` + tt.owner + `</D:owner></D:lockinfo>`
+		w := davRequest(t, "LOCK", tt.file, body, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.want) || strings.Contains(w.Body.String(), "evil") {
+			t.Errorf("%s: got %d %s", tt.file, w.Code, w.Body.String())
+		}
+		davRequest(t, "UNLOCK", tt.file, "", map[string]string{"Lock-Token": w.Header().Get("Lock-Token")})
+	}
+}
+
+func TestWebDAVLockBelowCollection(t *testing.T) {
+	setupServedDir(t, "dir/a.txt", "b.txt")
+	withWebDAVWrite(t)
+	body := `<?xml version="1.0"?><lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype></lockinfo>`
+	w := davRequest(t, "LOCK", "dir/a.txt", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("lock: got %d %s", w.Code, w.Body.String())
+	}
+	token := w.Header().Get("Lock-Token")
+	t.Cleanup(func() { davRequest(t, "UNLOCK", "dir/a.txt", "", map[string]string{"Lock-Token": token}) })
+	tests := []struct {
+		method  string
+		target  string
+		headers map[string]string
+		want    int
+	}{
+		{"DELETE", "dir", nil, http.StatusLocked},
+		{"MOVE", "dir", map[string]string{"Destination": davPrefix + "moved"}, http.StatusLocked},
+		{"COPY", "b.txt", map[string]string{"Destination": davPrefix + "dir"}, http.StatusLocked},
+		{"COPY", "dir", map[string]string{"Destination": davPrefix + "copied"}, http.StatusCreated},
+		{"DELETE", "dir", map[string]string{"If": "(" + token + ")"}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if w := davRequest(t, tt.method, tt.target, "", tt.headers); w.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestWebDAVPermissions(t *testing.T) {
+	dir := setupServedDir(t, "inbox/a.txt", "media/b.txt")
+	withWebDAVWrite(t)
+	withUploads(t, 0, 0, "inbox")
+	withManage(t, "inbox=delete", "media=mkdir")
+	dest := func(key string) map[string]string {
+		return map[string]string{"Destination": davPrefix + key}
+	}
+	var steps = []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		want    int
+	}{
+		{"put outside upload", "PUT", "media/c.txt", nil, http.StatusForbidden},
+		{"put new", "PUT", "inbox/c.txt", nil, http.StatusCreated},
+		{"put overwrite", "PUT", "inbox/c.txt", nil, http.StatusNoContent},
+		{"delete denied", "DELETE", "media/b.txt", nil, http.StatusForbidden},
+		{"mkcol denied", "MKCOL", "inbox/sub", nil, http.StatusForbidden},
+		{"mkcol", "MKCOL", "media/sub", nil, http.StatusCreated},
+		{"move denied", "MOVE", "inbox/a.txt", dest("inbox/d.txt"), http.StatusForbidden},
+		{"copy outside upload", "COPY", "inbox/a.txt", dest("media/d.txt"), http.StatusForbidden},
+		{"copy", "COPY", "media/b.txt", dest("inbox/b.txt"), http.StatusCreated},
+		{"delete", "DELETE", "inbox/a.txt", nil, http.StatusNoContent},
+	}
+	for _, s := range steps {
+		body := ""
+		if s.method == "PUT" {
+			body = "x"
+		}
+		if w := davRequest(t, s.method, s.target, body, s.headers); w.Code != s.want {
+			t.Fatalf("%s: got %d, want %d: %s", s.name, w.Code, s.want, w.Body.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "media/b.txt")); err != nil {
+		t.Errorf("refused delete removed the file: %v", err)
+	}
+	trashed, _ := filepath.Glob(filepath.Join(dir, trashDir, "*", "*.txt"))
+	if len(trashed) != 2 {
+		t.Errorf("trash holds %v, want a.txt and the overwritten c.txt", trashed)
+	}
+}
+
+func TestWebDAVPutSlowBody(t *testing.T) {
+	dir := setupServedDir(t, "a.txt")
+	withWebDAVWrite(t)
+	srv := httptest.NewUnstartedServer(davHandler)
+	srv.Config.ReadTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	// the body takes five times the ReadTimeout to arrive
+	r, err := http.NewRequest("PUT", srv.URL+davPrefix+"slow.txt", slowBody(strings.Split("0123456789", ""), 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if v, _ := os.ReadFile(filepath.Join(dir, "slow.txt")); res.StatusCode != http.StatusCreated || string(v) != "0123456789" {
+		t.Errorf("got %d %q", res.StatusCode, v)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// progressWrite is one file response waiting to be merged into its record.
+type progressWrite struct {
+	uri string
+	hit WatchHit
+}
+
+// WriteQueue takes writes, such as progress updates, off the request path. A single worker
+// drains the buffer and commits everything pending in one transaction, so
+// concurrent responses share a single fsync instead of queueing for the
+// bolt writer lock one by one. When the buffer is full the write happens
+// synchronously on the request, which slows clients down rather than
+// losing state.
+type WriteQueue[T any] struct {
+	ch       chan T
+	apply    func(writes []T) error
+	maxBatch int
+	done     chan struct{}
+	once     sync.Once
+	// mu keeps enqueue from sending on ch while Close closes it
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewWriteQueue[T any](size int, apply func(writes []T) error) *WriteQueue[T] {
+	wq := &WriteQueue[T]{
+		ch:       make(chan T, size),
+		apply:    apply,
+		maxBatch: size,
+		done:     make(chan struct{}),
+	}
+	go wq.run()
+	return wq
+}
+
+func (wq *WriteQueue[T]) run() {
+	defer close(wq.done)
+	batch := make([]T, 0, wq.maxBatch)
+	for w := range wq.ch {
+		batch = append(batch[:0], w)
+	drain:
+		for len(batch) < wq.maxBatch {
+			select {
+			case w, ok := <-wq.ch:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, w)
+			default:
+				break drain
+			}
+		}
+		wq.commit(batch)
+	}
+}
+
+func (wq *WriteQueue[T]) commit(batch []T) {
+	start := time.Now()
+	err := wq.apply(batch)
+	writeQueueBatch.observe(float64(len(batch)))
+	if err != nil {
+		slog.Error("write queue", "writes", len(batch), "err", err, "took", time.Since(start))
+	}
+}
+
+// enqueue hands a write to the worker, or applies it directly when the
+// buffer is full or the queue is closed.
+func (wq *WriteQueue[T]) enqueue(w T) error {
+	wq.mu.RLock()
+	if !wq.closed {
+		select {
+		case wq.ch <- w:
+			wq.mu.RUnlock()
+			return nil
+		default:
+		}
+	}
+	wq.mu.RUnlock()
+	writeQueueOverflow.inc()
+	return wq.apply([]T{w})
+}
+
+func (wq *WriteQueue[T]) depth() int {
+	return len(wq.ch)
+}
+
+// Close stops accepting writes and waits until everything buffered has
+// been committed.
+func (wq *WriteQueue[T]) Close() {
+	wq.once.Do(func() {
+		wq.mu.Lock()
+		wq.closed = true
+		close(wq.ch)
+		wq.mu.Unlock()
+	})
+	<-wq.done
+}
+
+var writeQueue *WriteQueue[progressWrite]
+
+// startWriteQueue switches logRequests to asynchronous progress writes.
+func startWriteQueue(size int) {
+	if size <= 0 {
+		return
+	}
+	bolton := GetBoltInstance()
+	writeQueue = NewWriteQueue(size, func(writes []progressWrite) error {
+		err := bolton.progressBatch(writes)
+		if err != nil {
+			return err
+		}
+		var watched []string
+		for _, w := range writes {
+			if w.hit.Watched {
+				watched = append(watched, w.uri)
+			}
+		}
+		if len(watched) > 0 {
+			linkIdentities(watched...)
+		}
+		return nil
+	})
+}
+
+// recordProgress stores the outcome of a file response, through the write
+// queue when one is running.
+func recordProgress(uri string, hit WatchHit) error {
+	if writeQueue != nil {
+		return writeQueue.enqueue(progressWrite{uri: uri, hit: hit})
+	}
+	err := GetBoltInstance().progress(uri, hit)
+	if err != nil {
+		return err
+	}
+	if hit.Watched {
+		linkIdentities(uri)
+	}
+	return nil
+}
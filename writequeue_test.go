@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWriteQueueBatchesAndFlushes(t *testing.T) {
+	gate := make(chan struct{})
+	var mu sync.Mutex
+	var batches [][]progressWrite
+	wq := NewWriteQueue(16, func(writes []progressWrite) error {
+		mu.Lock()
+		first := len(batches) == 0
+		batches = append(batches, append([]progressWrite(nil), writes...))
+		mu.Unlock()
+		if first {
+			<-gate
+		}
+		return nil
+	})
+	for i := 0; i < 10; i++ {
+		err := wq.enqueue(progressWrite{uri: fmt.Sprintf("f%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(gate)
+	wq.Close()
+	n := 0
+	for _, b := range batches {
+		n += len(b)
+	}
+	if n != 10 {
+		t.Fatalf("applied %d writes, want 10", n)
+	}
+	if len(batches) == 10 {
+		t.Errorf("writes were not batched: %d transactions", len(batches))
+	}
+}
+
+func TestWriteQueueOverflow(t *testing.T) {
+	gate := make(chan struct{})
+	var worker, direct atomic.Int32
+	wq := NewWriteQueue(1, func(writes []progressWrite) error {
+		if writes[0].uri == "first" {
+			worker.Add(1)
+			<-gate
+			return nil
+		}
+		if writes[0].uri == "direct" {
+			direct.Add(1)
+		}
+		return nil
+	})
+	_ = wq.enqueue(progressWrite{uri: "first"})
+	// wait until the worker holds "first"
+	for worker.Load() == 0 {
+		runtime.Gosched()
+	}
+	_ = wq.enqueue(progressWrite{uri: "buffered"})
+	err := wq.enqueue(progressWrite{uri: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direct.Load() != 1 {
+		t.Errorf("full queue did not apply the write synchronously")
+	}
+	close(gate)
+	wq.Close()
+	err = wq.enqueue(progressWrite{uri: "direct"})
+	if err != nil || direct.Load() != 2 {
+		t.Errorf("write after close was not applied: %v", err)
+	}
+}
+
+func TestRecordProgressThroughQueue(t *testing.T) {
+	startWriteQueue(8)
+	defer func() { writeQueue = nil }()
+	err := recordProgress("queued.mkv", WatchHit{Offset: 10, Size: 10, Watched: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeQueue.Close()
+	if !isWatched("queued.mkv") {
+		t.Errorf("queued write lost on close")
+	}
+}
+
+// benchmarkFileRequests serves small file responses through logRequests
+// from parallel clients against a fresh bolt store.
+func benchmarkFileRequests(b *testing.B, queue int) {
+	store, err := openBoltStore(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	saved := singleton
+	singleton = NewBolton(store)
+	savedTracker := watchTracker
+	watchTracker = NewWatchTracker(0, 50)
+	startWriteQueue(queue)
+	defer func() {
+		if writeQueue != nil {
+			writeQueue.Close()
+			writeQueue = nil
+		}
+		store.Close()
+		singleton = saved
+		watchTracker = savedTracker
+	}()
+	body := make([]byte, 512)
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setServedFile(r, int64(len(body)))
+		_, _ = w.Write(body)
+	}))
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.URL.Path = fmt.Sprintf("show/e%d.mkv", n.Add(1)%64)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	})
+}
+
+func BenchmarkFileRequestsSync(b *testing.B) {
+	benchmarkFileRequests(b, 0)
+}
+
+func BenchmarkFileRequestsQueued(b *testing.B) {
+	benchmarkFileRequests(b, 1024)
+}